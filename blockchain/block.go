@@ -2,19 +2,24 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"time"
 )
 
+var merkleHeightKey = []byte("merkleheight") // lowest MerkleRootHeight the stored chain needs
+
 type Block struct {
 	Hash       []byte
 	Nonce      int
 	Timestamp  int64
 	Difficulty int64
 	PrevHash   []byte
+	MerkleRoot []byte
 	Height     int64
 	Txs        []*Tx
 }
@@ -33,6 +38,57 @@ func (block *Block) HashTxs() []byte {
 	return tree.RootNode.Data
 }
 
+// the header must commit to the transactions, except on blocks older than merkle roots
+func (block *Block) CheckMerkleRoot() error {
+	if block.MerkleRoot == nil {
+		if block.Height < Params.MerkleRootHeight {
+			return nil
+		}
+		return errors.New("Block has no merkle root")
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTxs()) {
+		return errors.New("Merkle root does not match transactions")
+	}
+	return nil
+}
+
+// refuse a stored chain with blocks the merkle root rule would reject, the main
+// chain is scanned once and the height it needs is kept under merkleHeightKey
+func (chain *BlockChain) checkMerkleRootHeight() error {
+	if _, err := chain.GetLastBlock(); err != nil {
+		return nil
+	}
+
+	var needed int64
+	if data, err := chain.Database.Get(merkleHeightKey, nil); err == nil {
+		needed = int64(binary.BigEndian.Uint64(data))
+	} else {
+		iter := chain.Iterator()
+		for iter.Next() {
+			if iter.Block.MerkleRoot == nil {
+				needed = iter.Block.Height + 1
+				break
+			}
+		}
+		HandleErr(chain.Database.Put(merkleHeightKey, ToBytes(needed), nil))
+	}
+
+	if needed > Params.MerkleRootHeight {
+		return fmt.Errorf("Blocks below height %d were mined without merkle roots, set MERKLE_ROOT_HEIGHT=%d to use this chain", needed, needed)
+	}
+	return nil
+}
+
+// proof that the transaction at txIdx is committed to by the merkle root
+func (block *Block) MerkleProof(txIdx int) *MerkleProof {
+	var txHashes [][]byte
+
+	for _, tx := range block.Txs {
+		txHashes = append(txHashes, tx.ToBytes())
+	}
+	return NewMerkleProof(txHashes, txIdx)
+}
+
 func GetDifficulty(prevHash []byte, height int64, chain *BlockChain) int64 {
 
 	// if no previous block,
@@ -45,9 +101,11 @@ func GetDifficulty(prevHash []byte, height int64, chain *BlockChain) int64 {
 	timeDiff := time.Now().Unix() - prevBlock.Timestamp
 	if height%AdjustmentInverval == 0 {
 		if timeDiff > BlockMiningInterval*2 {
-			return prevBlock.Difficulty - 1
+			if prevBlock.Difficulty > 1 {
+				return prevBlock.Difficulty - 1
+			}
 		} else if timeDiff < BlockMiningInterval/2 {
-			if prevBlock.Difficulty != 0 {
+			if prevBlock.Difficulty < MaxDifficulty {
 				return prevBlock.Difficulty + 1
 			}
 		}
@@ -65,13 +123,23 @@ func (b *Block) ToBytes() []byte {
 }
 
 func Bytes2Block(data []byte) *Block {
+	block, err := DecodeBlock(data)
+	HandleErr(err)
+
+	return block
+}
+
+// decode a block from an untrusted source
+func DecodeBlock(data []byte) (*Block, error) {
 	var block Block
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
 	// squash raw bytes back into block structure
-	HandleErr(decoder.Decode(&block))
-	return &block
+	if err := decoder.Decode(&block); err != nil {
+		return nil, fmt.Errorf("Malformed block: %s", err)
+	}
+	return &block, nil
 }
 
 // Panic on error
@@ -90,6 +158,7 @@ func (block *Block) PrintBlock() {
 	fmt.Printf("\t|-Difficulty       : %d\n", block.Difficulty)
 	fmt.Printf("\t|-Hash             : %x\n", block.Hash)
 	fmt.Printf("\t|-PrevHash         : %x\n", block.PrevHash)
+	fmt.Printf("\t|-MerkleRoot       : %x\n", block.MerkleRoot)
 	fmt.Printf("\t|-Height           : %d\n", block.Height)
 
 	fmt.Println("\nTransactions")
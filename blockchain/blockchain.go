@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
@@ -20,6 +22,11 @@ const (
 
 type BlockChain struct {
 	Database *leveldb.DB
+	cache    *UTXOCache
+	mu       sync.Mutex // serializes changes to the chain and UTXO set
+
+	// blocks below the last checkpoint known by its header chain, by hash
+	checkpointed map[string]bool
 }
 
 // mint block using proof of work
@@ -36,6 +43,12 @@ func (chain *BlockChain) CreateBlock(txs []*Tx, prevHash []byte, height int64) *
 		Height:     height,
 		Txs:        txs,
 	}
+
+	// commit to transactions in the header
+	if len(txs) > 0 {
+		block.MerkleRoot = block.HashTxs()
+	}
+
 	pow := NewProof(block)
 	nonce, hash := pow.Run()
 
@@ -68,27 +81,31 @@ func (chain *BlockChain) CreateBlockChain(address, nodeID string) {
 	chain.AddBlock(genesis)
 }
 
+// whether hash is on the main chain
 func (chain *BlockChain) ContainsBlock(hash []byte) bool {
-	iter := chain.Iterator()
-
-	for iter.Next() {
-		if bytes.Compare(iter.Block.Hash, hash) == 0 {
-			return true
-		}
-	}
-	return false
+	block, err := chain.GetBlockByHash(hash)
+	return err == nil && chain.IsMainChain(&block)
 }
 
 func (chain *BlockChain) AddBlock(block *Block) {
 
-	// delete previous head
-	chain.Database.Delete([]byte("lh"), nil)
+	// block, "lh" (last-hash) and height index move together, readers never see
+	// a tip without its block
+	batch := new(leveldb.Batch)
+	batch.Put(block.Hash, block.ToBytes())
+	batch.Put([]byte("lh"), block.Hash)
+	batch.Put(heightKey(block.Height), block.Hash)
+	HandleErr(chain.Database.Write(batch, nil))
+
+	// light clients match against filters instead of blocks
+	chain.indexFilter(block)
+}
 
-	// reference block by hash
-	HandleErr(chain.Database.Put(block.Hash, block.ToBytes(), nil))
+func (chain *BlockChain) HasBlock(hash []byte) bool {
+	has, err := chain.Database.Has(hash, nil)
+	HandleErr(err)
 
-	// refernce hash by "lh" (last-hash)
-	HandleErr(chain.Database.Put([]byte("lh"), block.Hash, nil))
+	return has
 }
 
 func (chain *BlockChain) MineBlock(txs []*Tx) *Block {
@@ -155,6 +172,8 @@ func (chain *BlockChain) GetHashes() [][]byte {
 	return hashes
 }
 
+// safe without mu, "lh" only ever names a stored block, though the tip may move
+// on as soon as it is read
 func (chain *BlockChain) GetBestHeight() int64 {
 	lastBlock, err := chain.GetLastBlock()
 	if err != nil {
@@ -181,11 +200,82 @@ func ContinueBlockChain(nodeID string) *BlockChain {
 	// pass database to structure
 	chain := BlockChain{
 		Database: db,
+		cache:    NewUTXOCache(db),
+	}
+	chain.buildHeightIndex()
+	if err := chain.checkMerkleRootHeight(); err != nil {
+		db.Close()
+		log.Panic(err)
 	}
+	UTXOSet{BlockChain: &chain}.CheckVersion()
+	chain.recoverUTXO()
+	chain.buildFilterIndex()
 
 	return &chain
 }
 
+// flush cached UTXO changes and close the database
+func (chain *BlockChain) Close() {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	chain.cache.Flush()
+	chain.Database.Close()
+}
+
+// a flush in the middle of a block would save half of it
+func (chain *BlockChain) FlushUTXO() {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	chain.cache.Flush()
+}
+
+// the UTXO set on disk at a tip, with the tip's height, blocks connected while
+// it is scanned don't show, callers release it
+func (chain *BlockChain) utxoSnapshot() (*leveldb.Snapshot, int64) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	chain.cache.Flush()
+	snap, err := chain.Database.GetSnapshot()
+	HandleErr(err)
+
+	return snap, chain.GetBestHeight()
+}
+
+// replay blocks connected after the last flush, e.g. after a crash
+func (chain *BlockChain) recoverUTXO() {
+	var blocks []*Block
+
+	best := chain.cache.Best()
+	lastBlock, err := chain.GetLastBlock()
+	if best == nil || err != nil || bytes.Equal(best, lastBlock.Hash) {
+		return
+	}
+
+	iter := chain.Iterator()
+	for iter.Next() {
+		if bytes.Equal(iter.Block.Hash, best) {
+			break
+		}
+		blocks = append(blocks, iter.Block)
+	}
+
+	UTXOst := UTXOSet{BlockChain: chain}
+	if !bytes.Equal(iter.Block.Hash, best) {
+		fmt.Println("UTXO set is not on the main chain, reindexing")
+		UTXOst.Reindex()
+		return
+	}
+
+	fmt.Printf("Replaying %d blocks into the UTXO set\n", len(blocks))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		UTXOst.Update(blocks[i])
+	}
+	chain.cache.Flush()
+}
+
 func (chain *BlockChain) FindUnspentTxs(pubKeyHash []byte) []Tx {
 	var unspentTxs []Tx
 	spentTXOs := make(map[string][]int)
@@ -225,33 +315,38 @@ func (chain *BlockChain) FindUnspentTxs(pubKeyHash []byte) []Tx {
 	return unspentTxs
 }
 
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
-	spentTXOs := make(map[string][]int)
+func (chain *BlockChain) FindUTXO() map[string]UnspentOutput {
+	return chain.FindUTXOAt(chain.GetBestHeight())
+}
+
+// unspent outputs by UTXO key as they were after the block at height
+func (chain *BlockChain) FindUTXOAt(height int64) map[string]UnspentOutput {
+	UTXO := make(map[string]UnspentOutput)
+	spentTXOs := make(map[string]bool)
 
 	iter := chain.Iterator()
 
 	for iter.Next() {
-		for _, tx := range iter.Block.Txs {
-			txID := hex.EncodeToString(tx.ID)
+		if iter.Block.Height > height {
+			continue
+		}
+
+		// newest first, so spends are seen before the outputs they consume
+		for i := len(iter.Block.Txs) - 1; i >= 0; i-- {
+			tx := iter.Block.Txs[i]
 
-		Outputs:
 			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
+				key := string(utxoKey(tx.ID, outIdx))
+
+				// data carriers are unspendable
+				if spentTXOs[key] || out.IsDataCarrier() {
+					continue
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				UTXO[key] = UnspentOutput{out, iter.Block.Height, tx.IsCoinbase()}
 			}
 			if tx.IsCoinbase() == false {
 				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
+					spentTXOs[string(utxoKey(in.ID, in.Out))] = true
 				}
 			}
 		}
@@ -272,11 +367,37 @@ func (chain *BlockChain) FindTx(ID []byte) (Tx, error) {
 	return Tx{}, errors.New("Transaction does not exist")
 }
 
+// previous transaction for an input, nodes missing history fall back to the UTXO set
+func (chain *BlockChain) findPrevTx(ID []byte) (Tx, error) {
+	tx, err := chain.FindTx(ID)
+	if err == nil || chain.CanReindex() {
+		return tx, err
+	}
+
+	// rebuild what is left of the outputs at their original indices
+	chain.FlushUTXO()
+	prevTx := Tx{ID: ID}
+	it := chain.Database.NewIterator(util.BytesPrefix(append(append([]byte{}, utxoPrefix...), ID...)), nil)
+	defer it.Release()
+
+	for it.Next() {
+		_, outIdx := splitUTXOKey(it.Key())
+		for len(prevTx.Outputs) <= outIdx {
+			prevTx.Outputs = append(prevTx.Outputs, TxOut{})
+		}
+		prevTx.Outputs[outIdx] = Bytes2UnspentOutput(it.Value()).Output
+	}
+	if len(prevTx.Outputs) == 0 {
+		return Tx{}, errors.New("Transaction does not exist")
+	}
+	return prevTx, nil
+}
+
 func (chain *BlockChain) SignTx(tx *Tx, privKey ecdsa.PrivateKey) {
 	prevTXs := make(map[string]Tx)
 
 	for _, input := range tx.Inputs {
-		prevTX, err := chain.FindTx(input.ID)
+		prevTX, err := chain.findPrevTx(input.ID)
 		HandleErr(err)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
@@ -284,18 +405,64 @@ func (chain *BlockChain) SignTx(tx *Tx, privKey ecdsa.PrivateKey) {
 }
 
 func (chain *BlockChain) VerifyTx(tx *Tx) bool {
+	return chain.CheckTx(tx) == nil
+}
+
+// check a loose transaction against the chain and its unspent outputs, a
+// RuleError if no block could hold it
+func (chain *BlockChain) CheckTx(tx *Tx) error {
+	if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+		return RuleError{fmt.Errorf("Transaction %x has the wrong id", tx.ID)}
+	}
+	for _, out := range tx.Outputs {
+		if out.IsDataCarrier() && !out.IsValidDataCarrier() {
+			return RuleError{fmt.Errorf("Transaction %x has an invalid data carrier", tx.ID)}
+		}
+	}
+
 	if tx.IsCoinbase() {
-		return true
+		return RuleError{fmt.Errorf("Coinbase %x outside a block", tx.ID)}
 	}
 
 	prevTXs := make(map[string]Tx)
 
 	for _, input := range tx.Inputs {
-		prevTX, err := chain.FindTx(input.ID)
-		HandleErr(err)
+		prevTX, err := chain.findPrevTx(input.ID)
+		if err != nil {
+			return fmt.Errorf("Transaction %x spends unknown transaction %x", tx.ID, input.ID)
+		}
+
+		// data carriers can never be spent
+		if input.Out < 0 || input.Out >= len(prevTX.Outputs) || prevTX.Outputs[input.Out].IsDataCarrier() {
+			return RuleError{fmt.Errorf("Transaction %x spends invalid output %x:%d", tx.ID, input.ID, input.Out)}
+		}
+
+		// spent by a block we have, or one the sender has not seen yet
+		if _, err := (UTXOSet{BlockChain: chain}).GetUTXO(input.ID, input.Out); err != nil {
+			return fmt.Errorf("Transaction %x spends spent or missing output %x:%d", tx.ID, input.ID, input.Out)
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-	return tx.Verify(prevTXs)
+	if !tx.Verify(prevTXs) {
+		return RuleError{fmt.Errorf("Transaction %x has an invalid signature", tx.ID)}
+	}
+	return nil
+}
+
+// find the block and transaction carrying data
+func (chain *BlockChain) FindData(data []byte) (*Block, int, error) {
+	iter := chain.Iterator()
+
+	for iter.Next() {
+		for txIdx, tx := range iter.Block.Txs {
+			for _, out := range tx.Outputs {
+				if out.IsDataCarrier() && bytes.Equal(out.Data, data) {
+					return iter.Block, txIdx, nil
+				}
+			}
+		}
+	}
+	return nil, 0, errors.New("Data is not anchored")
 }
 
 // print blockchain block by block
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// each record is a 4 byte big endian length followed by a serialized block
+const maxBootstrapBlock = 32 << 20
+
+// write main chain blocks from..to (inclusive) to a flat file
+func (chain *BlockChain) ExportBlocks(path string, from, to int64) (int, error) {
+	if best := chain.GetBestHeight(); to < 0 || to > best {
+		to = best
+	}
+	if from < 0 || from > to {
+		return 0, fmt.Errorf("No blocks between heights %d and %d", from, to)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	count := 0
+	for height := from; height <= to; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return count, err
+		}
+		if !chain.HasBlockBody(block) {
+			return count, fmt.Errorf("Block %d is pruned", height)
+		}
+
+		data := block.ToBytes()
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+
+		if _, err := w.Write(length); err != nil {
+			return count, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, w.Flush()
+}
+
+// connect every block in a bootstrap file, skipping ones we have
+func (chain *BlockChain) ImportBlocks(path string) (imported, skipped int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	// blocks are connected through the cache, write it back either way
+	defer chain.FlushUTXO()
+
+	length := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, length); err == io.EOF {
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, err
+		}
+
+		size := binary.BigEndian.Uint32(length)
+		if size > maxBootstrapBlock {
+			return imported, skipped, fmt.Errorf("Record of %d bytes is too large", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return imported, skipped, fmt.Errorf("Truncated block record: %s", err)
+		}
+
+		block, err := DecodeBlock(data)
+		if err != nil {
+			return imported, skipped, fmt.Errorf("Undecodable block record: %s", err)
+		}
+
+		_, err = chain.ProcessBlock(block)
+		if err == ErrKnownBlock {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return imported, skipped, fmt.Errorf("Block %d rejected: %s", block.Height, err)
+		}
+		imported++
+	}
+}
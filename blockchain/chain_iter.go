@@ -1,6 +1,9 @@
 package blockchain
 
 import (
+	"bytes"
+	"fmt"
+
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -8,6 +11,7 @@ type BlockChainIterator struct {
 	CurrHash []byte
 	Block    *Block
 	Database *leveldb.DB
+	Backfill []byte // first block below a snapshot still to be downloaded
 }
 
 func (chain *BlockChain) Iterator() *BlockChainIterator {
@@ -24,6 +28,7 @@ func (chain *BlockChain) Iterator() *BlockChainIterator {
 		CurrHash: currHash,
 		Block:    &lastBlock,
 		Database: chain.Database,
+		Backfill: chain.BackfillHash(),
 	}
 
 	return iter
@@ -36,8 +41,14 @@ func (iter *BlockChainIterator) Next() bool {
 		return false
 	}
 
-	// get the current block
+	// get the current block, history below a snapshot may not be here yet
 	blockData, err := iter.Database.Get(iter.CurrHash, nil)
+	if err == leveldb.ErrNotFound && bytes.Equal(iter.CurrHash, iter.Backfill) {
+		return false
+	}
+	if err == leveldb.ErrNotFound {
+		HandleErr(fmt.Errorf("Block %x is missing from the chain", iter.CurrHash))
+	}
 	HandleErr(err)
 	currBlock := Bytes2Block(blockData)
 
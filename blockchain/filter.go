@@ -0,0 +1,283 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// golomb-rice parameters, false positive rate about 1/M
+const (
+	FilterP = 19
+	FilterM = 784931
+)
+
+var (
+	filterPrefix       = []byte("cf-")
+	filterHeaderPrefix = []byte("cfh-")
+)
+
+func filterKey(blockHash []byte) []byte {
+	return append(append([]byte{}, filterPrefix...), blockHash...)
+}
+
+func filterHeaderKey(blockHash []byte) []byte {
+	return append(append([]byte{}, filterHeaderPrefix...), blockHash...)
+}
+
+// pubkey hashes and data paid to, plus outpoints spent, by a block
+func FilterItems(block *Block) [][]byte {
+	var items [][]byte
+	seen := make(map[string]bool)
+
+	for _, tx := range block.Txs {
+		for _, item := range TxFilterItems(tx) {
+			if !seen[string(item)] {
+				seen[string(item)] = true
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// items a single transaction contributes to its block's filter
+func TxFilterItems(tx *Tx) [][]byte {
+	var items [][]byte
+
+	for _, out := range tx.Outputs {
+		item := out.PublicKeyHash
+		if out.IsDataCarrier() {
+			item = out.Data
+		}
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			items = append(items, OutpointItem(in.ID, in.Out))
+		}
+	}
+	return items
+}
+
+// filter item for a spent output
+func OutpointItem(txID []byte, out int) []byte {
+	return bytes.TrimPrefix(utxoKey(txID, out), utxoPrefix)
+}
+
+// map an item uniformly onto [0, n*M), keyed by the block
+func hashToRange(key, item []byte, n uint64) uint64 {
+	hash := sha256.Sum256(append(append([]byte{}, key...), item...))
+	hi, _ := bits.Mul64(binary.BigEndian.Uint64(hash[:8]), n*FilterM)
+	return hi
+}
+
+type bitWriter struct {
+	bytes []byte
+	bits  uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.bits%8 == 0 {
+		w.bytes = append(w.bytes, 0)
+	}
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> (w.bits % 8)
+	}
+	w.bits++
+}
+
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(value&(1<<(i-1)) != 0)
+	}
+}
+
+type bitReader struct {
+	bytes []byte
+	bits  uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.bits/8 >= uint(len(r.bytes)) {
+		return false, errors.New("Filter is truncated")
+	}
+	bit := r.bytes[r.bits/8]&(0x80>>(r.bits%8)) != 0
+	r.bits++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var value uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
+
+// golomb-coded set of items, prefixed by the item count
+func BuildFilter(key []byte, items [][]byte) []byte {
+	n := uint64(len(items))
+	values := make([]uint64, 0, n)
+	for _, item := range items {
+		values = append(values, hashToRange(key, item, n))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	w := bitWriter{}
+	last := uint64(0)
+	for _, value := range values {
+		delta := value - last
+		last = value
+
+		for q := delta >> FilterP; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, FilterP)
+	}
+
+	count := make([]byte, binary.MaxVarintLen64)
+	count = count[:binary.PutUvarint(count, n)]
+
+	return append(count, w.bytes...)
+}
+
+// whether any item may be in the filter, false positives are possible
+func MatchFilter(key, filter []byte, items [][]byte) (bool, error) {
+	n, size := binary.Uvarint(filter)
+	if size <= 0 {
+		return false, errors.New("Filter has no item count")
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+
+	wanted := make([]uint64, 0, len(items))
+	for _, item := range items {
+		wanted = append(wanted, hashToRange(key, item, n))
+	}
+	sort.Slice(wanted, func(i, j int) bool { return wanted[i] < wanted[j] })
+
+	r := bitReader{bytes: filter[size:]}
+	value := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		q := uint64(0)
+		for {
+			bit, err := r.readBit()
+			if err != nil {
+				return false, err
+			}
+			if !bit {
+				break
+			}
+			q++
+		}
+		rem, err := r.readBits(FilterP)
+		if err != nil {
+			return false, err
+		}
+		value += q<<FilterP | rem
+
+		// both lists are sorted, so walk them together
+		for len(wanted) > 0 && wanted[0] < value {
+			wanted = wanted[1:]
+		}
+		if len(wanted) == 0 {
+			return false, nil
+		}
+		if wanted[0] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// commits to a filter and, through prevHeader, every filter before it
+func FilterHeader(filter, prevHeader []byte) []byte {
+	filterHash := sha256.Sum256(filter)
+	return NextFilterHeader(filterHash[:], prevHeader)
+}
+
+func NextFilterHeader(filterHash, prevHeader []byte) []byte {
+	if prevHeader == nil {
+		prevHeader = make([]byte, sha256.Size)
+	}
+	hash := sha256.Sum256(append(append([]byte{}, filterHash...), prevHeader...))
+	return hash[:]
+}
+
+// filters are keyed by the block hash they were built for
+func (block *Block) Filter() []byte {
+	return BuildFilter(block.Hash, FilterItems(block))
+}
+
+func (chain *BlockChain) GetFilter(blockHash []byte) ([]byte, error) {
+	filter, err := chain.Database.Get(filterKey(blockHash), nil)
+	if err != nil {
+		return nil, errors.New("No filter for block")
+	}
+	return filter, nil
+}
+
+func (chain *BlockChain) GetFilterHeader(blockHash []byte) ([]byte, error) {
+	header, err := chain.Database.Get(filterHeaderKey(blockHash), nil)
+	if err != nil {
+		return nil, errors.New("No filter header for block")
+	}
+	return header, nil
+}
+
+// store the filter of a block whose parent's filter header is known
+func (chain *BlockChain) indexFilter(block *Block) {
+	var prevHeader []byte
+	if block.PrevHash != nil {
+		var err error
+		if prevHeader, err = chain.GetFilterHeader(block.PrevHash); err != nil {
+			return
+		}
+	}
+	if len(block.Txs) == 0 {
+		return
+	}
+
+	filter := block.Filter()
+	batch := new(leveldb.Batch)
+	batch.Put(filterKey(block.Hash), filter)
+	batch.Put(filterHeaderKey(block.Hash), FilterHeader(filter, prevHeader))
+	HandleErr(chain.Database.Write(batch, nil))
+}
+
+// filter chains created before filters were built, or back-filled below a snapshot
+func (chain *BlockChain) buildFilterIndex() {
+	var missing []*Block
+
+	for height := chain.GetBestHeight(); height >= 0; height-- {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil || len(block.Txs) == 0 {
+			return // history we don't have
+		}
+		if _, err := chain.GetFilterHeader(block.Hash); err == nil {
+			break
+		}
+		missing = append(missing, block)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		chain.indexFilter(missing[i])
+	}
+}
@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"bytes"
+	"exx/gochain/wallet"
+	"fmt"
+	"testing"
+)
+
+func filterTestItems(prefix string, n int) [][]byte {
+	var items [][]byte
+	for i := 0; i < n; i++ {
+		items = append(items, []byte(fmt.Sprintf("%s-%d", prefix, i)))
+	}
+	return items
+}
+
+func TestFilterRoundTrip(t *testing.T) {
+	key := []byte("block hash")
+	items := filterTestItems("in", 50)
+	filter := BuildFilter(key, items)
+
+	for _, item := range items {
+		match, err := MatchFilter(key, filter, [][]byte{item})
+		if err != nil || !match {
+			t.Fatalf("item %s not matched: %v", item, err)
+		}
+	}
+
+	// one in about FilterM, none of these should match
+	match, err := MatchFilter(key, filter, filterTestItems("out", 50))
+	if err != nil || match {
+		t.Fatalf("items not in the filter matched: %v", err)
+	}
+
+	// the key salts the filter
+	match, err = MatchFilter([]byte("other block"), filter, items[:1])
+	if err != nil || match {
+		t.Fatalf("item matched under another key: %v", err)
+	}
+}
+
+func TestEmptyFilter(t *testing.T) {
+	filter := BuildFilter([]byte("key"), nil)
+
+	match, err := MatchFilter([]byte("key"), filter, filterTestItems("in", 3))
+	if err != nil || match {
+		t.Fatalf("empty filter matched: %v", err)
+	}
+}
+
+// a filter cut short is an error, not a panic or a match
+func TestTruncatedFilter(t *testing.T) {
+	key := []byte("key")
+	items := filterTestItems("in", 50)
+	filter := BuildFilter(key, items)
+
+	for _, cut := range [][]byte{nil, filter[:1]} {
+		if _, err := MatchFilter(key, cut, items[:1]); err == nil {
+			t.Fatalf("filter of %d bytes matched without an error", len(cut))
+		}
+	}
+}
+
+// each filter header commits to its block's filter and the header before it
+func TestFilterHeaderChain(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+	mineBlock(t, chain, w)
+	mineBlock(t, chain, w)
+
+	var prevHeader []byte
+	for height := int64(0); height <= chain.GetBestHeight(); height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, err := chain.GetFilter(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := chain.GetFilterHeader(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(header, FilterHeader(filter, prevHeader)) {
+			t.Fatalf("filter header at height %d does not follow the one before", height)
+		}
+		if match, err := MatchFilter(block.Hash, filter, [][]byte{wallet.PublicKeyHash(w.PublicKey)}); err != nil || !match {
+			t.Fatalf("filter at height %d misses the coinbase address: %v", height, err)
+		}
+		prevHeader = header
+	}
+}
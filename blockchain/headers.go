@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// block without its transactions
+func (block *Block) Header() *Block {
+	header := *block
+	header.Txs = nil
+
+	return &header
+}
+
+// hashes from the tip back to genesis, dense at first then exponentially spaced
+func (chain *BlockChain) BlockLocator() [][]byte {
+	if _, err := chain.GetLastBlock(); err != nil {
+		return nil
+	}
+	return blockLocator(chain.GetBestHeight(), chain.GetHashByHeight)
+}
+
+func blockLocator(height int64, hashAt func(int64) ([]byte, error)) [][]byte {
+	var locator [][]byte
+	step := int64(1)
+
+	for {
+		hash, err := hashAt(height)
+		if err != nil {
+			break // history below a snapshot
+		}
+		locator = append(locator, hash)
+
+		if height == 0 {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height -= step
+		if height < 0 {
+			height = 0
+		}
+	}
+	return locator
+}
+
+// height of the first locator hash on our main chain, -1 if none are
+func (chain *BlockChain) FindForkHeight(locator [][]byte) int64 {
+	for _, hash := range locator {
+		block, err := chain.GetBlockByHash(hash)
+		if err == nil && chain.IsMainChain(&block) {
+			return block.Height
+		}
+	}
+	return -1
+}
+
+// up to max main chain headers following the locator's fork point
+func (chain *BlockChain) GetHeaders(locator [][]byte, max int) []*Block {
+	var headers []*Block
+	best := chain.GetBestHeight()
+
+	for height := chain.FindForkHeight(locator) + 1; height <= best && len(headers) < max; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			break
+		}
+		headers = append(headers, block.Header())
+	}
+	return headers
+}
+
+// difficulty, proof of work, linkage and heights of headers building on parent
+func CheckHeaders(parent *Block, headers []*Block) error {
+	prev := parent
+
+	for _, header := range headers {
+		if err := CheckDifficulty(prev, header); err != nil {
+			return err
+		}
+		if !NewProof(header).Validate() {
+			return fmt.Errorf("Header %x has invalid proof of work", header.Hash)
+		}
+		if err := CheckCheckpoint(header); err != nil {
+			return err
+		}
+
+		if prev == nil {
+			if header.PrevHash != nil || header.Height != 0 {
+				return errors.New("Headers do not start at genesis")
+			}
+		} else {
+			if !bytes.Equal(header.PrevHash, prev.Hash) {
+				return fmt.Errorf("Header %x does not link to %x", header.Hash, prev.Hash)
+			}
+			if header.Height != prev.Height+1 {
+				return fmt.Errorf("Header %x has height %d after %d", header.Hash, header.Height, prev.Height)
+			}
+		}
+		prev = header
+	}
+	return nil
+}
+
+// up to max main chain hashes following the locator's fork point, oldest first
+func (chain *BlockChain) GetHashesAfter(locator [][]byte, max int) [][]byte {
+	var hashes [][]byte
+	best := chain.GetBestHeight()
+
+	for height := chain.FindForkHeight(locator) + 1; height <= best && len(hashes) < max; height++ {
+		hash, err := chain.GetHashByHeight(height)
+		if err != nil {
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// heights a locator from height holds, when hashes exist from lowest up
+func locatorHeights(height, lowest int64) []int64 {
+	hashAt := func(h int64) ([]byte, error) {
+		if h < lowest {
+			return nil, errors.New("below the snapshot")
+		}
+		return ToBytes(h), nil
+	}
+
+	var heights []int64
+	for _, hash := range blockLocator(height, hashAt) {
+		heights = append(heights, int64(binary.BigEndian.Uint64(hash)))
+	}
+	return heights
+}
+
+// ten consecutive hashes, then doubling steps down to genesis
+func TestBlockLocatorSpacing(t *testing.T) {
+	tests := []struct {
+		height, lowest int64
+		want           []int64
+	}{
+		{3, 0, []int64{3, 2, 1, 0}},
+		{100, 0, []int64{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61, 29, 0}},
+		{100, 50, []int64{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61}},
+	}
+	for _, test := range tests {
+		if got := locatorHeights(test.height, test.lowest); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("locator from %d with history from %d: %v, want %v", test.height, test.lowest, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var heightPrefix = []byte("h-") // main chain hash by height
+
+func heightKey(height int64) []byte {
+	return append(append([]byte{}, heightPrefix...), ToBytes(height)...)
+}
+
+func (chain *BlockChain) GetHashByHeight(height int64) ([]byte, error) {
+	hash, err := chain.Database.Get(heightKey(height), nil)
+	if err != nil {
+		return nil, fmt.Errorf("No block at height %d", height)
+	}
+	return hash, nil
+}
+
+func (chain *BlockChain) GetBlockByHeight(height int64) (*Block, error) {
+	hash, err := chain.GetHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := chain.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (chain *BlockChain) IsMainChain(block *Block) bool {
+	hash, err := chain.GetHashByHeight(block.Height)
+	return err == nil && bytes.Equal(hash, block.Hash)
+}
+
+// index chains created before heights were indexed
+func (chain *BlockChain) buildHeightIndex() {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return
+	}
+	if _, err := chain.GetHashByHeight(lastBlock.Height); err == nil {
+		return
+	}
+
+	iter := chain.Iterator()
+	for iter.Next() {
+		HandleErr(chain.Database.Put(heightKey(iter.Block.Height), iter.Block.Hash, nil))
+	}
+}
@@ -0,0 +1,303 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const LightDBPath = "./tmp/light_%s"
+
+var (
+	lightTxPrefix = []byte("ltx-")
+	scanKey       = []byte("lscan") // height filters were checked up to
+)
+
+// header chain plus the wallet's own transactions
+type LightChain struct {
+	Database *leveldb.DB
+}
+
+// transaction proven to be in a block
+type LightTx struct {
+	Tx        Tx
+	BlockHash []byte
+	Height    int64
+	Proof     MerkleProof
+}
+
+// unspent output known to a light client
+type LightOutput struct {
+	TxID          []byte
+	Out           int
+	Value         int
+	Height        int64
+	Confirmations int64
+	Coinbase      bool
+}
+
+func lightTxKey(txID []byte) []byte {
+	return append(append([]byte{}, lightTxPrefix...), txID...)
+}
+
+func OpenLightChain(nodeID string) *LightChain {
+	db, err := leveldb.OpenFile(fmt.Sprintf(LightDBPath, nodeID), nil)
+	HandleErr(err)
+
+	return &LightChain{db}
+}
+
+func (light *LightChain) Close() {
+	light.Database.Close()
+}
+
+func (light *LightChain) Tip() (*Block, error) {
+	hash, err := light.Database.Get([]byte("lh"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return light.GetHeader(hash)
+}
+
+func (light *LightChain) BestHeight() int64 {
+	tip, err := light.Tip()
+	if err != nil {
+		return 0
+	}
+	return tip.Height
+}
+
+func (light *LightChain) GetHeader(hash []byte) (*Block, error) {
+	data, err := light.Database.Get(hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Bytes2Block(data), nil
+}
+
+func (light *LightChain) GetHashByHeight(height int64) ([]byte, error) {
+	hash, err := light.Database.Get(heightKey(height), nil)
+	if err != nil {
+		return nil, fmt.Errorf("No header at height %d", height)
+	}
+	return hash, nil
+}
+
+func (light *LightChain) IsMainChain(header *Block) bool {
+	hash, err := light.GetHashByHeight(header.Height)
+	return err == nil && bytes.Equal(hash, header.Hash)
+}
+
+func (light *LightChain) BlockLocator() [][]byte {
+	if _, err := light.Tip(); err != nil {
+		return nil
+	}
+	return blockLocator(light.BestHeight(), light.GetHashByHeight)
+}
+
+// validate and store headers, switching to them if they make the chain with most work
+func (light *LightChain) AddHeaders(headers []*Block) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	var parent *Block
+	if first := headers[0]; first.PrevHash != nil {
+		var err error
+		if parent, err = light.GetHeader(first.PrevHash); err != nil {
+			return errors.New("Headers do not connect to our chain")
+		}
+	}
+	if err := CheckHeaders(parent, headers); err != nil {
+		return RuleError{err}
+	}
+
+	batch := new(leveldb.Batch)
+	for _, header := range headers {
+		batch.Put(header.Hash, header.Header().ToBytes())
+	}
+	HandleErr(light.Database.Write(batch, nil))
+
+	last := headers[len(headers)-1]
+	if _, err := light.Tip(); err == nil && light.extraWork(last).Sign() <= 0 {
+		return nil
+	}
+	light.setTip(last)
+
+	return nil
+}
+
+// work the branch ending in tip has over the main chain, from where they meet
+func (light *LightChain) extraWork(tip *Block) *big.Int {
+	work := big.NewInt(0)
+	fork := int64(-1)
+
+	for curr := tip; ; {
+		if light.IsMainChain(curr) {
+			fork = curr.Height
+			break
+		}
+		work.Add(work, curr.Work())
+		if curr.PrevHash == nil {
+			break
+		}
+
+		var err error
+		curr, err = light.GetHeader(curr.PrevHash)
+		HandleErr(err)
+	}
+
+	for height := fork + 1; height <= light.BestHeight(); height++ {
+		hash, err := light.GetHashByHeight(height)
+		HandleErr(err)
+		header, err := light.GetHeader(hash)
+		HandleErr(err)
+		work.Sub(work, header.Work())
+	}
+	return work
+}
+
+// point the height index at the branch ending in tip, which has the most work
+func (light *LightChain) setTip(tip *Block) {
+	batch := new(leveldb.Batch)
+	curr := tip
+
+	for !light.IsMainChain(curr) {
+		batch.Put(heightKey(curr.Height), curr.Hash)
+		if curr.PrevHash == nil {
+			break
+		}
+
+		var err error
+		curr, err = light.GetHeader(curr.PrevHash)
+		HandleErr(err)
+	}
+	fork := curr.Height
+	if !light.IsMainChain(curr) {
+		fork = -1
+	}
+
+	// a branch with more work can be shorter, the old heights past it are gone
+	for height := tip.Height + 1; height <= light.BestHeight(); height++ {
+		batch.Delete(heightKey(height))
+	}
+	batch.Put([]byte("lh"), tip.Hash)
+
+	// filters past the fork belong to other blocks now
+	if light.ScanHeight() > fork {
+		batch.Put(scanKey, ToBytes(fork))
+	}
+	HandleErr(light.Database.Write(batch, nil))
+}
+
+func (light *LightChain) PutFilterHeader(blockHash, header []byte) {
+	HandleErr(light.Database.Put(filterHeaderKey(blockHash), header, nil))
+}
+
+func (light *LightChain) GetFilterHeader(blockHash []byte) ([]byte, error) {
+	header, err := light.Database.Get(filterHeaderKey(blockHash), nil)
+	if err != nil {
+		return nil, errors.New("No filter header for block")
+	}
+	return header, nil
+}
+
+// -1 until the first filter is checked
+func (light *LightChain) ScanHeight() int64 {
+	data, err := light.Database.Get(scanKey, nil)
+	if err != nil {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+func (light *LightChain) SetScanHeight(height int64) {
+	HandleErr(light.Database.Put(scanKey, ToBytes(height), nil))
+}
+
+// keep a transaction whose proof matches a header we have
+func (light *LightChain) AddTransaction(tx *Tx, blockHash []byte, proof *MerkleProof) error {
+	header, err := light.GetHeader(blockHash)
+	if err != nil {
+		return errors.New("Transaction is in an unknown block")
+	}
+	if !proof.Verify(tx.ToBytes(), header.MerkleRoot) {
+		return RuleError{fmt.Errorf("Transaction %x is not in block %x", tx.ID, blockHash)}
+	}
+
+	ltx := LightTx{*tx, blockHash, header.Height, *proof}
+	var buffer bytes.Buffer
+	HandleErr(gob.NewEncoder(&buffer).Encode(ltx))
+
+	return light.Database.Put(lightTxKey(tx.ID), buffer.Bytes(), nil)
+}
+
+// proven transactions in main chain blocks
+func (light *LightChain) Transactions() []LightTx {
+	var txs []LightTx
+
+	it := light.Database.NewIterator(util.BytesPrefix(lightTxPrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		var ltx LightTx
+		HandleErr(gob.NewDecoder(bytes.NewReader(it.Value())).Decode(&ltx))
+
+		header, err := light.GetHeader(ltx.BlockHash)
+		if err == nil && light.IsMainChain(header) {
+			txs = append(txs, ltx)
+		}
+	}
+	return txs
+}
+
+// unspent outputs to pubKeyHash with their confirmation depth
+func (light *LightChain) Outputs(pubKeyHash []byte) []LightOutput {
+	var outputs []LightOutput
+	txs := light.Transactions()
+	tip := light.BestHeight()
+
+	spent := make(map[string]bool)
+	for _, ltx := range txs {
+		if !ltx.Tx.IsCoinbase() {
+			for _, in := range ltx.Tx.Inputs {
+				spent[string(utxoKey(in.ID, in.Out))] = true
+			}
+		}
+	}
+
+	for _, ltx := range txs {
+		for outIdx, out := range ltx.Tx.Outputs {
+			if !out.IsLockedWithKey(pubKeyHash) || spent[string(utxoKey(ltx.Tx.ID, outIdx))] {
+				continue
+			}
+			outputs = append(outputs, LightOutput{
+				TxID:          ltx.Tx.ID,
+				Out:           outIdx,
+				Value:         out.Value,
+				Height:        ltx.Height,
+				Confirmations: tip - ltx.Height + 1,
+				Coinbase:      ltx.Tx.IsCoinbase(),
+			})
+		}
+	}
+	return outputs
+}
+
+// filter items for the wallet: its pubkey hashes and the outputs it owns
+func (light *LightChain) WatchItems(pubKeyHashes [][]byte) [][]byte {
+	items := append([][]byte{}, pubKeyHashes...)
+
+	for _, pubKeyHash := range pubKeyHashes {
+		for _, out := range light.Outputs(pubKeyHash) {
+			items = append(items, OutpointItem(out.TxID, out.Out))
+		}
+	}
+	return items
+}
@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// headers after parent at the given difficulties
+func mineHeaders(parent *Block, difficulties ...int64) []*Block {
+	var headers []*Block
+	for _, difficulty := range difficulties {
+		parent = mineHeader(parent, difficulty)
+		headers = append(headers, parent)
+	}
+	return headers
+}
+
+func testLightChain(t *testing.T) *LightChain {
+	nodeID := t.Name()
+	os.RemoveAll(fmt.Sprintf(LightDBPath, nodeID))
+	light := OpenLightChain(nodeID)
+	t.Cleanup(light.Close)
+
+	return light
+}
+
+// a branch with more work but fewer headers takes the heights it doesn't reach too
+func TestLightReorgToShorterBranch(t *testing.T) {
+	light := testLightChain(t)
+
+	genesis := mineHeader(nil, InitialDifficulty)
+	base := append([]*Block{genesis}, mineHeaders(genesis, 15, 15, 15, 15)...)
+	if err := light.AddHeaders(base); err != nil {
+		t.Fatal(err)
+	}
+
+	// easier blocks from the adjustment height on
+	long := mineHeaders(base[4], 14, 14, 14)
+	if err := light.AddHeaders(long); err != nil {
+		t.Fatal(err)
+	}
+	if light.BestHeight() != 7 {
+		t.Fatalf("best height %d after the long branch", light.BestHeight())
+	}
+
+	// one harder block outweighs them
+	short := mineHeaders(base[4], 16)
+	if err := light.AddHeaders(short); err != nil {
+		t.Fatal(err)
+	}
+
+	tip, err := light.Tip()
+	if err != nil || !bytes.Equal(tip.Hash, short[0].Hash) {
+		t.Fatal("branch with more work is not the tip")
+	}
+	for _, header := range long {
+		if light.IsMainChain(header) {
+			t.Fatalf("header at height %d still on the main chain", header.Height)
+		}
+	}
+	for height := int64(6); height <= 7; height++ {
+		if _, err := light.GetHashByHeight(height); err == nil {
+			t.Fatalf("height %d still indexed past the tip", height)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"exx/gochain/wallet"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// chains go under a scratch directory, as ./tmp would for the cli
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gochain")
+	HandleErr(err)
+	HandleErr(os.Chdir(dir))
+
+	Params.CoinbaseMaturity = 0
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// a chain named after the test with a genesis block paying w
+func testChain(t *testing.T, w *wallet.Wallet) *BlockChain {
+	t.Helper()
+
+	nodeID := t.Name()
+	os.RemoveAll(fmt.Sprintf(DBPath, nodeID))
+	chain := ContinueBlockChain(nodeID)
+	t.Cleanup(chain.Close)
+
+	chain.CreateBlockChain(string(w.GetAddress()), nodeID)
+	UTXOSet{BlockChain: chain}.Reindex()
+
+	return chain
+}
+
+// mine txs and a coinbase paying w on top of the tip
+func mineBlock(t *testing.T, chain *BlockChain, w *wallet.Wallet, txs ...*Tx) *Block {
+	t.Helper()
+
+	txs = append(txs, CoinbaseTx(string(w.GetAddress()), ""))
+	block := chain.MineBlock(txs)
+	if _, err := chain.ProcessBlock(block); err != nil {
+		t.Fatalf("block %d rejected: %s", block.Height, err)
+	}
+	return block
+}
+
+// an empty header mined on top of parent, or genesis for nil
+func mineHeader(parent *Block, difficulty int64) *Block {
+	header := &Block{Timestamp: time.Now().Unix(), Difficulty: difficulty}
+	if parent != nil {
+		header.PrevHash = parent.Hash
+		header.Height = parent.Height + 1
+	}
+	header.Nonce, header.Hash = NewProof(header).Run()
+	return header
+}
@@ -1,6 +1,7 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"log"
 )
@@ -63,3 +64,58 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 
 	return &tree
 }
+
+// sibling hashes from a leaf up to the root
+type MerkleProof struct {
+	Hashes [][]byte
+	Left   []bool // sibling sits on the left of the path
+}
+
+func NewMerkleProof(data [][]byte, index int) *MerkleProof {
+	var level [][]byte
+	proof := MerkleProof{}
+
+	if index < 0 || index >= len(data) {
+		log.Panic("Merkle proof index out of range")
+	}
+
+	// hash leaves the same way as the tree
+	for _, dat := range data {
+		level = append(level, NewMerkleNode(nil, nil, dat).Data)
+	}
+
+	// collect sibling at each level
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		sibling := index ^ 1
+		proof.Hashes = append(proof.Hashes, level[sibling])
+		proof.Left = append(proof.Left, sibling < index)
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			node := NewMerkleNode(&MerkleNode{Data: level[i]}, &MerkleNode{Data: level[i+1]}, nil)
+			next = append(next, node.Data)
+		}
+		level = next
+		index /= 2
+	}
+	return &proof
+}
+
+func (proof *MerkleProof) Verify(leaf, root []byte) bool {
+	hash := sha256.Sum256(leaf)
+	curr := hash[:]
+
+	for i, sibling := range proof.Hashes {
+		if proof.Left[i] {
+			hash = sha256.Sum256(append(append([]byte{}, sibling...), curr...))
+		} else {
+			hash = sha256.Sum256(append(append([]byte{}, curr...), sibling...))
+		}
+		curr = hash[:]
+	}
+	return bytes.Equal(curr, root)
+}
@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMerkleProofVerify(t *testing.T) {
+	var data [][]byte
+	for i := 0; i < 5; i++ {
+		data = append(data, []byte{byte(i)})
+	}
+	root := NewMerkleTree(data).RootNode.Data
+
+	for i := range data {
+		if !NewMerkleProof(data, i).Verify(data[i], root) {
+			t.Fatalf("proof for leaf %d does not verify", i)
+		}
+	}
+
+	proof := NewMerkleProof(data, 2)
+	if proof.Verify(data[3], root) {
+		t.Fatal("proof verifies another leaf")
+	}
+
+	// a changed sibling or side leads to another root
+	proof.Hashes[1] = append([]byte{}, proof.Hashes[1]...)
+	proof.Hashes[1][0] ^= 1
+	if proof.Verify(data[2], root) {
+		t.Fatal("proof with a tampered branch verifies")
+	}
+	proof = NewMerkleProof(data, 2)
+	proof.Left[0] = !proof.Left[0]
+	if proof.Verify(data[2], root) {
+		t.Fatal("proof with a swapped side verifies")
+	}
+}
+
+// a chain mined before merkle roots opens only with the activation height past it
+func TestMerkleRootHeightLegacyChain(t *testing.T) {
+	nodeID := t.Name()
+	os.RemoveAll(fmt.Sprintf(DBPath, nodeID))
+
+	chain := ContinueBlockChain(nodeID)
+	genesis := mineHeader(nil, InitialDifficulty)
+	chain.AddBlock(genesis)
+	chain.AddBlock(mineHeader(genesis, InitialDifficulty))
+	chain.Close()
+
+	defer func(height int64) { Params.MerkleRootHeight = height }(Params.MerkleRootHeight)
+	Params.MerkleRootHeight = 1
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("legacy chain opened below its activation height")
+			}
+		}()
+		ContinueBlockChain(nodeID)
+	}()
+
+	Params.MerkleRootHeight = 2
+	ContinueBlockChain(nodeID).Close()
+}
@@ -0,0 +1,35 @@
+package blockchain
+
+type ChainParams struct {
+
+	// blocks that must be mined on top of a coinbase before it can be spent
+	CoinbaseMaturity int64
+
+	// trusted UTXO snapshot hashes (hex) by height
+	AssumeUTXO map[int64]string
+
+	// known good block hashes (hex) by height, hardcode them here
+	Checkpoints map[int64]string
+
+	// blocks below this height were mined before headers committed to transactions,
+	// chains from before merkle roots need it raised past their last such block
+	MerkleRootHeight int64
+}
+
+var Params = ChainParams{
+	CoinbaseMaturity: 10,
+	AssumeUTXO:       map[int64]string{},
+	Checkpoints:      map[int64]string{},
+	MerkleRootHeight: 0,
+}
+
+// highest checkpointed height, -1 without checkpoints
+func (params *ChainParams) LastCheckpoint() int64 {
+	last := int64(-1)
+	for height := range params.Checkpoints {
+		if height > last {
+			last = height
+		}
+	}
+	return last
+}
@@ -13,6 +13,7 @@ import (
 
 const (
 	InitialDifficulty   = 15
+	MaxDifficulty       = 255 // the target keeps at least one bit
 	BlockMiningInterval = 10
 	AdjustmentInverval  = 5
 )
@@ -24,15 +25,49 @@ type ProofOfWork struct {
 
 func NewProof(b *Block) *ProofOfWork {
 
-	// left bitshift
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-b.Difficulty))
+	// no hash is below a zero target, so a difficulty out of range never validates
+	target := big.NewInt(0)
+	if b.Difficulty > 0 && b.Difficulty <= MaxDifficulty {
+
+		// left bitshift
+		target.SetInt64(1)
+		target.Lsh(target, uint(256-b.Difficulty))
+	}
 
 	pow := &ProofOfWork{b, target}
 
 	return pow
 }
 
+// difficulty of a block after parent, which is nil for genesis
+func CheckDifficulty(parent, block *Block) error {
+	if block.Difficulty <= 0 || block.Difficulty > MaxDifficulty {
+		return fmt.Errorf("Block %x has difficulty %d out of range", block.Hash, block.Difficulty)
+	}
+	if parent == nil {
+		if block.Difficulty != InitialDifficulty {
+			return fmt.Errorf("Genesis block has difficulty %d, not %d", block.Difficulty, InitialDifficulty)
+		}
+		return nil
+	}
+
+	// it moves by one at most, and only at adjustment heights
+	change := block.Difficulty - parent.Difficulty
+	if change != 0 && block.Height%AdjustmentInverval != 0 {
+		return fmt.Errorf("Block %x changes difficulty at height %d", block.Hash, block.Height)
+	}
+	if change < -1 || change > 1 {
+		return fmt.Errorf("Block %x changes difficulty by %d", block.Hash, change)
+	}
+	return nil
+}
+
+// expected number of hashes to mine the block
+func (block *Block) Work() *big.Int {
+	work := big.NewInt(1)
+	return work.Lsh(work, uint(block.Difficulty))
+}
+
 func (pow *ProofOfWork) InitData(nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
@@ -41,8 +76,7 @@ func (pow *ProofOfWork) InitData(nonce int) []byte {
 			ToBytes(int64(pow.Block.Difficulty)),
 			pow.Block.PrevHash,
 			ToBytes(int64(pow.Block.Height)),
-
-			// pow.Block.HashTxs(),
+			pow.Block.MerkleRoot,
 		},
 		[]byte{},
 	)
@@ -84,7 +118,8 @@ func (pow *ProofOfWork) Validate() bool {
 
 	intHash.SetBytes(hash[:])
 
-	return intHash.Cmp(pow.Target) == -1
+	// claimed hash must be the one that was worked for
+	return intHash.Cmp(pow.Target) == -1 && bytes.Equal(hash[:], pow.Block.Hash)
 }
 
 func ToBytes(num int64) []byte {
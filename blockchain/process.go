@@ -0,0 +1,435 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrKnownBlock  = errors.New("Block already known")
+	ErrOrphanBlock = errors.New("Block parent is unknown")
+)
+
+// a block breaking consensus rules, as opposed to failing on our side
+type RuleError struct {
+	Err error
+}
+
+func (e RuleError) Error() string {
+	return e.Err.Error()
+}
+
+// blocks that left and joined the main chain
+type ChainUpdate struct {
+	Disconnected []*Block
+	Connected    []*Block
+}
+
+// validate a block, store it and make it the tip if it has the most work
+func (chain *BlockChain) ProcessBlock(block *Block) (*ChainUpdate, error) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	update := &ChainUpdate{}
+
+	if chain.HasBlock(block.Hash) {
+		return update, ErrKnownBlock
+	}
+	if err := chain.CheckBlock(block); err != nil {
+		return update, RuleError{err}
+	}
+
+	tip, err := chain.GetLastBlock()
+	hasTip := err == nil
+
+	// genesis of an empty chain
+	if !hasTip {
+		if block.PrevHash != nil || block.Height != 0 {
+			return update, ErrOrphanBlock
+		}
+		if err := CheckDifficulty(nil, block); err != nil {
+			return update, RuleError{err}
+		}
+		if err := chain.connectBlock(block); err != nil {
+			return update, err
+		}
+		update.Connected = append(update.Connected, block)
+		return update, nil
+	}
+
+	parent, err := chain.GetBlockByHash(block.PrevHash)
+	if err != nil {
+		return update, ErrOrphanBlock
+	}
+	if block.Height != parent.Height+1 {
+		return update, RuleError{fmt.Errorf("Block height %d does not follow parent %d", block.Height, parent.Height)}
+	}
+	if err := CheckDifficulty(&parent, block); err != nil {
+		return update, RuleError{err}
+	}
+
+	// extends the tip
+	if bytes.Equal(block.PrevHash, tip.Hash) {
+		if err := chain.connectBlock(block); err != nil {
+			return update, err
+		}
+		update.Connected = append(update.Connected, block)
+		chain.Prune()
+		return update, nil
+	}
+
+	// side branches may not fork below a checkpoint we have passed
+	fork, branch, err := chain.findFork(block)
+	if err != nil {
+		return update, err
+	}
+	if last := chain.lastPassedCheckpoint(); fork.Height < last {
+		return update, RuleError{fmt.Errorf("Block forks at height %d, below checkpoint %d", fork.Height, last)}
+	}
+	HandleErr(chain.Database.Put(block.Hash, block.ToBytes(), nil))
+
+	// keep branches with no more work than the main chain on the side
+	if chain.branchWork(branch).Cmp(chain.workSince(fork, &tip)) <= 0 {
+		fmt.Printf("Stored side branch block %x at height %d\n", block.Hash, block.Height)
+		return update, nil
+	}
+
+	if err := chain.reorganize(fork, branch, update); err != nil {
+		return update, err
+	}
+	chain.Prune()
+	return update, nil
+}
+
+// context free checks
+func (chain *BlockChain) CheckBlock(block *Block) error {
+	if block.Difficulty <= 0 || block.Difficulty > MaxDifficulty {
+		return fmt.Errorf("Block has difficulty %d out of range", block.Difficulty)
+	}
+	if !NewProof(block).Validate() {
+		return errors.New("Block has invalid proof of work")
+	}
+	if len(block.Txs) == 0 {
+		return errors.New("Block has no transactions")
+	}
+	if err := block.CheckMerkleRoot(); err != nil {
+		return err
+	}
+	return CheckCheckpoint(block)
+}
+
+func CheckCheckpoint(block *Block) error {
+	checkpoint, ok := Params.Checkpoints[block.Height]
+	if ok && checkpoint != hex.EncodeToString(block.Hash) {
+		return fmt.Errorf("Block %x conflicts with checkpoint at height %d", block.Hash, block.Height)
+	}
+	return nil
+}
+
+// skip signatures on the blocks of headers, the last checkpoint's first then its
+// ancestors, as the checkpoint vouches for them
+func (chain *BlockChain) AssumeCheckpointed(headers []*Block) {
+	last := Params.LastCheckpoint()
+	if len(headers) == 0 || headers[0].Height != last || CheckCheckpoint(headers[0]) != nil {
+		return
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	if chain.checkpointed == nil {
+		chain.checkpointed = make(map[string]bool)
+	}
+	for i, header := range headers {
+		if i > 0 && !bytes.Equal(headers[i-1].PrevHash, header.Hash) {
+			return
+		}
+		if !chain.HasBlock(header.Hash) {
+			chain.checkpointed[string(header.Hash)] = true
+		}
+	}
+}
+
+// highest checkpoint the main chain has reached
+func (chain *BlockChain) lastPassedCheckpoint() int64 {
+	best := chain.GetBestHeight()
+	last := int64(-1)
+
+	for height := range Params.Checkpoints {
+		if height <= best && height > last {
+			last = height
+		}
+	}
+	return last
+}
+
+// walk a side branch back to the main chain, branch is returned oldest first
+func (chain *BlockChain) findFork(block *Block) (*Block, []*Block, error) {
+	branch := []*Block{block}
+	curr := block
+
+	for {
+		parent, err := chain.GetBlockByHash(curr.PrevHash)
+		if err != nil {
+			return nil, nil, ErrOrphanBlock
+		}
+		if chain.IsMainChain(&parent) {
+			for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+				branch[i], branch[j] = branch[j], branch[i]
+			}
+			return &parent, branch, nil
+		}
+		branch = append(branch, &parent)
+		curr = &parent
+	}
+}
+
+func (chain *BlockChain) branchWork(branch []*Block) *big.Int {
+	work := big.NewInt(0)
+	for _, block := range branch {
+		work.Add(work, block.Work())
+	}
+	return work
+}
+
+// work of the main chain blocks above fork
+func (chain *BlockChain) workSince(fork, tip *Block) *big.Int {
+	work := big.NewInt(0)
+	for height := fork.Height + 1; height <= tip.Height; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		HandleErr(err)
+		work.Add(work, block.Work())
+	}
+	return work
+}
+
+// switch the main chain to branch, restoring the old one if it fails
+func (chain *BlockChain) reorganize(fork *Block, branch []*Block, update *ChainUpdate) error {
+	for {
+		tip, err := chain.GetLastBlock()
+		HandleErr(err)
+		if bytes.Equal(tip.Hash, fork.Hash) {
+			break
+		}
+		if err := chain.disconnectTip(); err != nil {
+			return err
+		}
+		update.Disconnected = append(update.Disconnected, &tip)
+	}
+
+	for i, block := range branch {
+		err := chain.connectBlock(block)
+		if err == nil {
+			update.Connected = append(update.Connected, block)
+			continue
+		}
+		fmt.Printf("Reorganization failed at block %x: %s\n", block.Hash, err)
+
+		// undo the part of the branch that did connect
+		for j := i - 1; j >= 0; j-- {
+			HandleErr(chain.disconnectTip())
+		}
+		for j := len(update.Disconnected) - 1; j >= 0; j-- {
+			HandleErr(chain.connectBlock(update.Disconnected[j]))
+		}
+		update.Connected = nil
+		update.Disconnected = nil
+		return err
+	}
+	fmt.Printf("Reorganized %d blocks at fork %d\n", len(update.Disconnected), fork.Height)
+	return nil
+}
+
+// apply a block on top of the tip
+func (chain *BlockChain) connectBlock(block *Block) error {
+	UTXOst := UTXOSet{BlockChain: chain}
+
+	// bring a stale set up to the tip first
+	if tip, err := chain.GetLastBlock(); err == nil && !bytes.Equal(UTXOst.BestBlock(), tip.Hash) {
+		if !chain.CanReindex() {
+			return errors.New("UTXO set is not at the tip")
+		}
+		UTXOst.Reindex()
+	}
+
+	if err := chain.checkBlockTxs(block); err != nil {
+		return RuleError{err}
+	}
+	UTXOst.Update(block)
+	chain.AddBlock(block)
+	delete(chain.checkpointed, string(block.Hash))
+
+	return nil
+}
+
+func (chain *BlockChain) disconnectTip() error {
+	tip, err := chain.GetLastBlock()
+	HandleErr(err)
+
+	if !chain.HasBlockBody(&tip) {
+		return fmt.Errorf("Cannot disconnect pruned block %d", tip.Height)
+	}
+	if _, err := chain.Database.Get(undoKey(tip.Hash), nil); err != nil {
+		return fmt.Errorf("No undo data to disconnect block %d", tip.Height)
+	}
+
+	UTXOst := UTXOSet{BlockChain: chain}
+	UTXOst.Undo(&tip)
+
+	HandleErr(chain.Database.Delete(heightKey(tip.Height), nil))
+	HandleErr(chain.Database.Put([]byte("lh"), tip.PrevHash, nil))
+
+	return nil
+}
+
+// check transactions against the UTXO set the block builds on
+func (chain *BlockChain) checkBlockTxs(block *Block) error {
+	view := newTxView()
+	coinbases := 0
+
+	// history leading to the checkpoint was signed off already
+	verifySigs := !chain.checkpointed[string(block.Hash)]
+
+	for _, tx := range block.Txs {
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+		if err := chain.checkBlockTx(tx, view, block.Height, verifySigs); err != nil {
+			return err
+		}
+	}
+
+	if coinbases != 1 {
+		return fmt.Errorf("Block has %d coinbase transactions", coinbases)
+	}
+	return nil
+}
+
+// outputs created and spent by the transactions of a block checked so far
+type txView struct {
+	created map[string]UnspentOutput
+	spent   map[string]bool
+}
+
+func newTxView() *txView {
+	return &txView{
+		created: make(map[string]UnspentOutput),
+		spent:   make(map[string]bool),
+	}
+}
+
+// check one transaction of a block at height, adding it to view if it passes
+func (chain *BlockChain) checkBlockTx(tx *Tx, view *txView, height int64, verifySigs bool) error {
+	UTXOst := UTXOSet{BlockChain: chain}
+
+	if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+		return fmt.Errorf("Transaction %x has the wrong id", tx.ID)
+	}
+
+	outValue := 0
+	for _, out := range tx.Outputs {
+		if out.Value < 0 {
+			return fmt.Errorf("Transaction %x has a negative output", tx.ID)
+		}
+		if out.IsDataCarrier() && !out.IsValidDataCarrier() {
+			return fmt.Errorf("Transaction %x has an invalid data carrier", tx.ID)
+		}
+		outValue += out.Value
+	}
+
+	var spends []string
+	if tx.IsCoinbase() {
+		if outValue > BlockReward {
+			return fmt.Errorf("Coinbase %x pays %d, more than the reward", tx.ID, outValue)
+		}
+	} else {
+		inValue := 0
+		prevTXs := make(map[string]Tx)
+
+		if len(tx.Inputs) == 0 {
+			return fmt.Errorf("Transaction %x has no inputs", tx.ID)
+		}
+
+		for _, in := range tx.Inputs {
+			key := string(utxoKey(in.ID, in.Out))
+			if view.spent[key] {
+				return fmt.Errorf("Transaction %x double spends %x:%d", tx.ID, in.ID, in.Out)
+			}
+
+			utxo, ok := view.created[key]
+			if !ok {
+				var err error
+				if utxo, err = UTXOst.GetUTXO(in.ID, in.Out); err != nil {
+					return fmt.Errorf("Transaction %x spends missing output %x:%d", tx.ID, in.ID, in.Out)
+				}
+			}
+			if !utxo.IsMature(height) {
+				return fmt.Errorf("Transaction %x spends immature coinbase %x", tx.ID, in.ID)
+			}
+			for _, spent := range spends {
+				if spent == key {
+					return fmt.Errorf("Transaction %x double spends %x:%d", tx.ID, in.ID, in.Out)
+				}
+			}
+			spends = append(spends, key)
+			inValue += utxo.Output.Value
+
+			// only the spent outputs are needed to check signatures
+			prevTX := prevTXs[hex.EncodeToString(in.ID)]
+			prevTX.ID = in.ID
+			for len(prevTX.Outputs) <= in.Out {
+				prevTX.Outputs = append(prevTX.Outputs, TxOut{})
+			}
+			prevTX.Outputs[in.Out] = utxo.Output
+			prevTXs[hex.EncodeToString(in.ID)] = prevTX
+		}
+
+		if outValue > inValue {
+			return fmt.Errorf("Transaction %x spends %d but has only %d", tx.ID, outValue, inValue)
+		}
+		if verifySigs && !tx.Verify(prevTXs) {
+			return fmt.Errorf("Transaction %x has an invalid signature", tx.ID)
+		}
+	}
+
+	// a failed transaction leaves the view as it was
+	for _, key := range spends {
+		view.spent[key] = true
+	}
+	for outIdx, out := range tx.Outputs {
+		if !out.IsDataCarrier() {
+			view.created[string(utxoKey(tx.ID, outIdx))] = UnspentOutput{out, height, tx.IsCoinbase()}
+		}
+	}
+	return nil
+}
+
+// the transactions of txs a block on the tip can hold, in an order it can hold
+// them, and the ones it can't
+func (chain *BlockChain) SelectTxs(txs []*Tx) (selected, rejected []*Tx) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	view := newTxView()
+	height := chain.GetBestHeight() + 1
+
+	// a transaction may spend one that comes later in txs
+	pending := txs
+	for progress := true; progress; {
+		progress = false
+		var failed []*Tx
+		for _, tx := range pending {
+			if tx.IsCoinbase() || chain.checkBlockTx(tx, view, height, true) != nil {
+				failed = append(failed, tx)
+				continue
+			}
+			selected = append(selected, tx)
+			progress = true
+		}
+		pending = failed
+	}
+	return selected, pending
+}
@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// reorganizations deeper than this can't be undone on a node that is not pruned
+const UndoDepth = 288
+
+var (
+	pruneDepthKey   = []byte("prunedepth")
+	prunedHeightKey = []byte("prunedheight")
+	undoHeightKey   = []byte("undoheight") // highest block whose undo data is gone
+)
+
+// blocks deeper than depth below the tip lose their bodies and undo data
+func (chain *BlockChain) EnablePruning(depth int64) {
+	if depth < 1 {
+		log.Panic("Prune depth must be at least 1")
+	}
+	HandleErr(chain.Database.Put(pruneDepthKey, []byte(strconv.FormatInt(depth, 10)), nil))
+}
+
+// 0 when the node keeps every block
+func (chain *BlockChain) PruneDepth() int64 {
+	data, err := chain.Database.Get(pruneDepthKey, nil)
+	if err != nil {
+		return 0
+	}
+	depth, err := strconv.ParseInt(string(data), 10, 64)
+	HandleErr(err)
+
+	return depth
+}
+
+func (chain *BlockChain) IsPruned() bool {
+	return chain.PruneDepth() > 0
+}
+
+// highest block without a body, -1 if none were pruned
+func (chain *BlockChain) PrunedHeight() int64 {
+	data, err := chain.Database.Get(prunedHeightKey, nil)
+	if err != nil {
+		return -1
+	}
+	height, err := strconv.ParseInt(string(data), 10, 64)
+	HandleErr(err)
+
+	return height
+}
+
+func (chain *BlockChain) HasBlockBody(block *Block) bool {
+	return block.Height > chain.PrunedHeight()
+}
+
+// strip undo data from blocks deeper than the undo window, which is the prune depth
+// on a pruned node, and bodies too from blocks below the prune depth
+func (chain *BlockChain) Prune() int64 {
+	chain.pruneUndo()
+
+	depth := chain.PruneDepth()
+	if depth == 0 {
+		return -1
+	}
+
+	prunedHeight := chain.PrunedHeight()
+	target := chain.GetBestHeight() - depth
+
+	// blocks not yet flushed to the UTXO set on disk may be replayed
+	if flushed, err := chain.GetBlockByHash(chain.cache.FlushedBest()); err == nil && flushed.Height < target {
+		target = flushed.Height
+	}
+	if target <= prunedHeight {
+		return prunedHeight
+	}
+
+	// only blocks pruned since the last call are visited
+	batch := new(leveldb.Batch)
+	for height := prunedHeight + 1; height <= target; height++ {
+		hash, err := chain.GetHashByHeight(height)
+		HandleErr(err)
+		block, err := chain.GetBlockByHash(hash)
+		HandleErr(err)
+
+		// keep only the header
+		block.Txs = nil
+		batch.Put(block.Hash, block.ToBytes())
+		batch.Delete(undoKey(block.Hash))
+	}
+	batch.Put(prunedHeightKey, []byte(strconv.FormatInt(target, 10)))
+	HandleErr(chain.Database.Write(batch, nil))
+
+	return target
+}
+
+// drop undo data of main chain blocks that left the undo window
+func (chain *BlockChain) pruneUndo() {
+	depth := chain.PruneDepth()
+	if depth == 0 {
+		depth = UndoDepth
+	}
+	target := chain.GetBestHeight() - depth
+
+	undone := int64(-1)
+	if data, err := chain.Database.Get(undoHeightKey, nil); err == nil {
+		undone, err = strconv.ParseInt(string(data), 10, 64)
+		HandleErr(err)
+	}
+	if target <= undone {
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	for height := undone + 1; height <= target; height++ {
+		if hash, err := chain.GetHashByHeight(height); err == nil {
+			batch.Delete(undoKey(hash))
+		}
+	}
+	batch.Put(undoHeightKey, []byte(strconv.FormatInt(target, 10)))
+	HandleErr(chain.Database.Write(batch, nil))
+}
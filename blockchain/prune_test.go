@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"exx/gochain/wallet"
+	"testing"
+)
+
+// whether the body and the undo data of block are still stored
+func stored(t *testing.T, chain *BlockChain, block *Block) (body, undo bool) {
+	t.Helper()
+
+	header, err := chain.GetBlockByHash(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = chain.Database.Get(undoKey(block.Hash), nil)
+
+	return len(header.Txs) > 0, err == nil
+}
+
+// undo data stays for the blocks within the undo window, bodies for the ones
+// within the prune depth
+func TestPruneKeepsUndoWindow(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+
+	var blocks []*Block
+	for i := 0; i < 6; i++ {
+		blocks = append(blocks, mineBlock(t, chain, w))
+	}
+
+	// fewer than UndoDepth blocks, nothing is dropped
+	chain.Prune()
+	for _, block := range blocks {
+		if body, undo := stored(t, chain, block); !body || !undo {
+			t.Fatalf("block %d lost its body or undo data on a node that is not pruned", block.Height)
+		}
+	}
+
+	// flushed first, blocks the UTXO set on disk may replay are never pruned
+	chain.EnablePruning(2)
+	chain.cache.Flush()
+	if pruned := chain.Prune(); pruned != 4 {
+		t.Fatalf("pruned to height %d, not 4", pruned)
+	}
+
+	blocks = append(blocks, mineBlock(t, chain, w))
+	chain.cache.Flush()
+	if pruned := chain.Prune(); pruned != 5 {
+		t.Fatalf("pruned to height %d, not 5", pruned)
+	}
+
+	for _, block := range blocks {
+		body, undo := stored(t, chain, block)
+		if keep := block.Height > 5; body != keep || undo != keep {
+			t.Fatalf("block %d has body %t and undo data %t", block.Height, body, undo)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var backfillKey = []byte("backfill") // next missing block below a snapshot
+
+type SnapshotEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// UTXO set as of Block, new blocks connect on top of it
+type UTXOSnapshot struct {
+	Height  int64
+	Block   []byte
+	Entries []SnapshotEntry
+	Hash    []byte
+}
+
+// the block the set is as of, snapshot files come from other nodes
+func (snap *UTXOSnapshot) BaseBlock() (*Block, error) {
+	var block Block
+
+	if err := gob.NewDecoder(bytes.NewReader(snap.Block)).Decode(&block); err != nil {
+		return nil, fmt.Errorf("Malformed snapshot base block: %s", err)
+	}
+	return &block, nil
+}
+
+// content hash over the height, base block hash and every entry
+func (snap *UTXOSnapshot) ContentHash() ([]byte, error) {
+	hasher := sha256.New()
+	block, err := snap.BaseBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hasher.Write(ToBytes(snap.Height))
+	hasher.Write(block.Hash)
+	for _, entry := range snap.Entries {
+		length := make([]byte, 4)
+
+		binary.BigEndian.PutUint32(length, uint32(len(entry.Key)))
+		hasher.Write(length)
+		hasher.Write(entry.Key)
+
+		binary.BigEndian.PutUint32(length, uint32(len(entry.Value)))
+		hasher.Write(length)
+		hasher.Write(entry.Value)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// write the UTXO set after the block at height to path
+func (u UTXOSet) DumpSnapshot(path string, height int64) *UTXOSnapshot {
+	chain := u.BlockChain
+	snap := UTXOSnapshot{Height: height}
+
+	block, err := chain.GetBlockByHeight(height)
+	HandleErr(err)
+	snap.Block = block.ToBytes()
+
+	stored, best := chain.utxoSnapshot()
+	defer stored.Release()
+
+	if height == best {
+
+		// the stored set is already at the tip
+		it := stored.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+		for it.Next() {
+			snap.Entries = append(snap.Entries, SnapshotEntry{
+				Key:   append([]byte{}, it.Key()...),
+				Value: append([]byte{}, it.Value()...),
+			})
+		}
+		it.Release()
+		HandleErr(it.Error())
+	} else {
+		if !chain.CanReindex() {
+			HandleErr(errors.New("Cannot rebuild a past UTXO set without the full chain history"))
+		}
+
+		// replay history up to height
+		for key, utxo := range chain.FindUTXOAt(height) {
+			snap.Entries = append(snap.Entries, SnapshotEntry{
+				Key:   []byte(key),
+				Value: utxo.ToBytes(),
+			})
+		}
+		sort.Slice(snap.Entries, func(i, j int) bool {
+			return bytes.Compare(snap.Entries[i].Key, snap.Entries[j].Key) < 0
+		})
+	}
+	snap.Hash, err = snap.ContentHash()
+	HandleErr(err)
+
+	var content bytes.Buffer
+	HandleErr(gob.NewEncoder(&content).Encode(snap))
+	HandleErr(ioutil.WriteFile(path, content.Bytes(), 0644))
+
+	return &snap
+}
+
+// load a snapshot into an empty node, history is back-filled later
+func (chain *BlockChain) LoadSnapshot(path string) (*UTXOSnapshot, error) {
+	var snap UTXOSnapshot
+
+	if _, err := chain.GetLastBlock(); err == nil {
+		return nil, errors.New("Chain already exists")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	// file must be intact and trusted by the chain params
+	hash, err := snap.ContentHash()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash, snap.Hash) {
+		return nil, errors.New("Snapshot content does not match its hash")
+	}
+	trusted, ok := Params.AssumeUTXO[snap.Height]
+	if !ok || trusted != hex.EncodeToString(hash) {
+		return nil, fmt.Errorf("Snapshot %x at height %d is not in the chain params", hash, snap.Height)
+	}
+
+	block, err := snap.BaseBlock()
+	if err != nil {
+		return nil, err
+	}
+	if block.Height != snap.Height || !NewProof(block).Validate() {
+		return nil, errors.New("Snapshot base block is invalid")
+	}
+
+	batch := new(leveldb.Batch)
+	for _, entry := range snap.Entries {
+		if !bytes.HasPrefix(entry.Key, utxoPrefix) {
+			return nil, fmt.Errorf("Unexpected snapshot key %x", entry.Key)
+		}
+		batch.Put(entry.Key, entry.Value)
+	}
+	if block.PrevHash != nil {
+		batch.Put(backfillKey, block.PrevHash)
+	}
+	batch.Put(utxoBestKey, block.Hash)
+	HandleErr(chain.Database.Write(batch, nil))
+	chain.cache.Reset(block.Hash)
+
+	chain.AddBlock(block)
+
+	return &snap, nil
+}
+
+// hash of the next block to back-fill, nil once history is complete
+func (chain *BlockChain) BackfillHash() []byte {
+	hash, err := chain.Database.Get(backfillKey, nil)
+	if err != nil {
+		return nil
+	}
+	return hash
+}
+
+// blocks below the snapshot are stored without touching the UTXO set
+func (chain *BlockChain) AddHistoricalBlock(block *Block) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	if !bytes.Equal(block.Hash, chain.BackfillHash()) {
+		return errors.New("Block is not the next one to back-fill")
+	}
+	if !NewProof(block).Validate() {
+		return errors.New("Block has invalid proof of work")
+	}
+
+	HandleErr(chain.Database.Put(block.Hash, block.ToBytes(), nil))
+	HandleErr(chain.Database.Put(heightKey(block.Height), block.Hash, nil))
+
+	// filter headers chain from genesis, so they start once history is complete
+	if block.PrevHash == nil {
+		HandleErr(chain.Database.Delete(backfillKey, nil))
+		chain.buildFilterIndex()
+	} else {
+		HandleErr(chain.Database.Put(backfillKey, block.PrevHash, nil))
+	}
+	return nil
+}
+
+// UTXO set can only be rebuilt from a complete, unpruned chain
+func (chain *BlockChain) CanReindex() bool {
+	return !chain.IsPruned() && chain.BackfillHash() == nil
+}
@@ -0,0 +1,30 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// a snapshot file whose base block doesn't decode is refused, not a panic
+func TestLoadSnapshotMalformedBlock(t *testing.T) {
+	nodeID := t.Name()
+	os.RemoveAll(fmt.Sprintf(DBPath, nodeID))
+	chain := ContinueBlockChain(nodeID)
+	defer chain.Close()
+
+	var content bytes.Buffer
+	HandleErr(gob.NewEncoder(&content).Encode(UTXOSnapshot{Height: 1, Block: []byte("not a block")}))
+	path := nodeID + ".snapshot"
+	HandleErr(ioutil.WriteFile(path, content.Bytes(), 0644))
+
+	if _, err := chain.LoadSnapshot(path); err == nil {
+		t.Fatal("snapshot with a malformed base block loaded")
+	}
+	if _, err := chain.GetLastBlock(); err == nil {
+		t.Fatal("malformed snapshot left a tip behind")
+	}
+}
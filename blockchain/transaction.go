@@ -10,10 +10,21 @@ import (
 	"encoding/hex"
 	"exx/gochain/wallet"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 )
 
+const BlockReward = 10 // coins minted by each coinbase
+
+// gob numbers types in the order a process first meets them, so register the
+// hashed types up front to encode them to the same bytes in every process
+func init() {
+	for _, value := range []interface{}{&Tx{}, &Block{}, &UnspentOutput{}} {
+		HandleErr(gob.NewEncoder(ioutil.Discard).Encode(value))
+	}
+}
+
 type Tx struct {
 	ID      []byte
 	Inputs  []TxIn
@@ -62,7 +73,10 @@ func (tx *Tx) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Tx) {
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
 		HandleErr(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		// fixed-width halves so verify can split them back apart
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 
 		tx.Inputs[inId].Sig = signature
 		txCopy.Inputs[inId].PubKey = nil
@@ -77,7 +91,7 @@ func (tx *Tx) TrimmedCopy() Tx {
 		inputs = append(inputs, TxIn{input.ID, input.Out, nil, nil})
 	}
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOut{out.Value, out.PublicKeyHash})
+		outputs = append(outputs, TxOut{out.Value, out.PublicKeyHash, out.Data})
 	}
 
 	txCopy := Tx{tx.ID, inputs, outputs}
@@ -134,12 +148,21 @@ func (tx *Tx) Verify(prevTXs map[string]Tx) bool {
 }
 
 func Bytes2Tx(data []byte) Tx {
+	tx, err := DecodeTx(data)
+	HandleErr(err)
+
+	return tx
+}
+
+// decode a transaction from an untrusted source
+func DecodeTx(data []byte) (Tx, error) {
 	var tx Tx
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
-	HandleErr(dec.Decode(&tx))
-
-	return tx
+	if err := dec.Decode(&tx); err != nil {
+		return tx, fmt.Errorf("Malformed transaction: %s", err)
+	}
+	return tx, nil
 }
 
 func CoinbaseTx(to, data string) *Tx {
@@ -153,7 +176,7 @@ func CoinbaseTx(to, data string) *Tx {
 	}
 
 	txin := TxIn{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTxOut(10, to) // 10 coin block minting reward
+	txout := NewTxOut(BlockReward, to)
 
 	tx := Tx{nil, []TxIn{txin}, []TxOut{*txout}}
 	tx.ID = tx.Hash()
@@ -196,6 +219,41 @@ func NewTx(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tx {
 	return &tx
 }
 
+// anchor data on chain, the change output returns all inputs to the sender
+func NewDataTx(w *wallet.Wallet, data []byte, UTXO *UTXOSet) *Tx {
+	var inputs []TxIn
+	var outputs []TxOut
+
+	// spend at least one coin so the data is bound to a key
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, 1)
+
+	if acc < 1 {
+		log.Panic("Error: not enough funds")
+	}
+
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		HandleErr(err)
+
+		for _, out := range outs {
+			input := TxIn{txID, out, nil, w.PublicKey}
+			inputs = append(inputs, input)
+		}
+	}
+
+	// change returns everything to the sender
+	from := fmt.Sprintf("%s", w.GetAddress())
+	outputs = append(outputs, *NewTxOut(acc, from))
+	outputs = append(outputs, *NewDataTxOut(data))
+
+	tx := Tx{nil, inputs, outputs}
+	tx.ID = tx.Hash()
+	UTXO.BlockChain.SignTx(&tx, w.PrivateKey)
+
+	return &tx
+}
+
 func (tx *Tx) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
@@ -213,6 +271,9 @@ func (tx *Tx) PrintTx() {
 		fmt.Printf("\t|-----output %d-----\n", i+1)
 		fmt.Printf("\t\t|-Value      :  %d\n", out.Value)
 		fmt.Printf("\t\t|-Public Key :  %x\n", out.PublicKeyHash)
+		if out.IsDataCarrier() {
+			fmt.Printf("\t\t|-Data       :  %x\n", out.Data)
+		}
 	}
 	fmt.Println("")
 }
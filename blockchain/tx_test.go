@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"exx/gochain/wallet"
+	"testing"
+)
+
+// a transaction spending the same inputs as tx, paying amount back to w
+func respend(chain *BlockChain, w *wallet.Wallet, tx *Tx, amount int) *Tx {
+	var inputs []TxIn
+	for _, in := range tx.Inputs {
+		inputs = append(inputs, TxIn{in.ID, in.Out, nil, w.PublicKey})
+	}
+	double := &Tx{nil, inputs, []TxOut{*NewTxOut(amount, string(w.GetAddress()))}}
+	double.ID = double.Hash()
+	chain.SignTx(double, w.PrivateKey)
+
+	return double
+}
+
+func TestCheckTxRejectsSpentOutput(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+
+	tx := NewTx(w, string(w.GetAddress()), 1, &UTXOSet{BlockChain: chain})
+	if err := chain.CheckTx(tx); err != nil {
+		t.Fatalf("unspent input rejected: %s", err)
+	}
+	mineBlock(t, chain, w, tx)
+
+	double := respend(chain, w, tx, 2)
+	err := chain.CheckTx(double)
+	if err == nil {
+		t.Fatal("spent input accepted")
+	}
+
+	// the sender may not have seen the block yet, that isn't misbehavior
+	if _, ok := err.(RuleError); ok {
+		t.Fatalf("spent input is a rule error: %s", err)
+	}
+}
+
+func TestSelectTxsDropsDoubleSpend(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+
+	tx := NewTx(w, string(w.GetAddress()), 1, &UTXOSet{BlockChain: chain})
+	double := respend(chain, w, tx, 2)
+
+	selected, rejected := chain.SelectTxs([]*Tx{tx, double})
+	if len(selected) != 1 || len(rejected) != 1 || rejected[0] != double {
+		t.Fatalf("selected %d and rejected %d transactions", len(selected), len(rejected))
+	}
+
+	// what was selected makes a valid block
+	block := mineBlock(t, chain, w, selected...)
+	if chain.GetBestHeight() != block.Height {
+		t.Fatal("block with the selected transactions is not the tip")
+	}
+}
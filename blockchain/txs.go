@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"encoding/gob"
 	"exx/gochain/wallet"
+	"log"
 )
 
+// largest payload a data-carrier output may hold
+const MaxDataCarrierSize = 80
+
 type TxOut struct {
 	Value         int
 	PublicKeyHash []byte
+	Data          []byte
 }
 
 type TxIn struct {
@@ -18,17 +23,28 @@ type TxIn struct {
 	PubKey []byte
 }
 
-type TxOutputs struct {
-	Outputs []TxOut
+// unspent output with where it was created
+type UnspentOutput struct {
+	Output   TxOut
+	Height   int64 // height of the block holding the transaction
+	Coinbase bool
 }
 
 func NewTxOut(value int, address string) *TxOut {
-	txo := &TxOut{value, nil}
+	txo := &TxOut{value, nil, nil}
 	txo.Lock([]byte(address))
 
 	return txo
 }
 
+// zero value output carrying arbitrary data, it can never be spent
+func NewDataTxOut(data []byte) *TxOut {
+	if len(data) == 0 || len(data) > MaxDataCarrierSize {
+		log.Panicf("Data carrier must hold 1 to %d bytes", MaxDataCarrierSize)
+	}
+	return &TxOut{0, nil, data}
+}
+
 func (in *TxIn) UsesKey(pubKeyHash []byte) bool {
 	lockingHash := wallet.PublicKeyHash(in.PubKey)
 
@@ -42,21 +58,35 @@ func (out *TxOut) Lock(address []byte) {
 }
 
 func (out *TxOut) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PublicKeyHash, pubKeyHash) == 0
+	return !out.IsDataCarrier() && bytes.Compare(out.PublicKeyHash, pubKeyHash) == 0
+}
+
+func (out *TxOut) IsDataCarrier() bool {
+	return len(out.Data) > 0
+}
+
+// data carriers must be empty of value and unlocked
+func (out *TxOut) IsValidDataCarrier() bool {
+	return out.Value == 0 && len(out.PublicKeyHash) == 0 && len(out.Data) <= MaxDataCarrierSize
+}
+
+// coinbase outputs can only be spent in blocks far enough above them
+func (utxo *UnspentOutput) IsMature(height int64) bool {
+	return !utxo.Coinbase || height-utxo.Height >= Params.CoinbaseMaturity
 }
 
-func (outs *TxOutputs) ToBytes() []byte {
+func (utxo *UnspentOutput) ToBytes() []byte {
 	var buffer bytes.Buffer
 
 	encode := gob.NewEncoder(&buffer)
-	HandleErr(encode.Encode(outs))
+	HandleErr(encode.Encode(utxo))
 
 	return buffer.Bytes()
 }
 
-func Bytes2Txoutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
+func Bytes2UnspentOutput(data []byte) UnspentOutput {
+	var utxo UnspentOutput
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	HandleErr(decoder.Decode(&outputs))
-	return outputs
+	HandleErr(decoder.Decode(&utxo))
+	return utxo
 }
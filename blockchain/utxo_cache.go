@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const cacheEntryOverhead = 64 // rough cost of map entry and bookkeeping
+
+var (
+	// approximate bytes the UTXO cache may hold before it is flushed
+	UTXOCacheBudget = 32 << 20
+
+	utxoBestKey = []byte("utxobest") // block the UTXO set on disk reflects
+)
+
+type cacheEntry struct {
+	value []byte // nil once spent
+	dirty bool
+}
+
+// write-back cache in front of the utxo- keys, flushed atomically
+type UTXOCache struct {
+	mu      sync.Mutex
+	db      *leveldb.DB
+	entries map[string]*cacheEntry
+	best    []byte
+	size    int
+}
+
+func NewUTXOCache(db *leveldb.DB) *UTXOCache {
+	best, err := db.Get(utxoBestKey, nil)
+	if err != nil {
+		best = nil
+	}
+
+	return &UTXOCache{
+		db:      db,
+		entries: make(map[string]*cacheEntry),
+		best:    best,
+	}
+}
+
+func (c *UTXOCache) Get(key []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[string(key)]; ok {
+		return entry.value, entry.value != nil
+	}
+
+	// load from disk and keep it warm
+	value, err := c.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false
+	}
+	HandleErr(err)
+
+	c.set(key, &cacheEntry{value: value})
+	return value, true
+}
+
+func (c *UTXOCache) Put(key, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(key, &cacheEntry{value: value, dirty: true})
+}
+
+func (c *UTXOCache) Delete(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(key, &cacheEntry{dirty: true})
+}
+
+func (c *UTXOCache) set(key []byte, entry *cacheEntry) {
+	if old, ok := c.entries[string(key)]; ok {
+		c.size -= len(key) + len(old.value) + cacheEntryOverhead
+	}
+	c.entries[string(key)] = entry
+	c.size += len(key) + len(entry.value) + cacheEntryOverhead
+}
+
+// block hash the cached set reflects
+func (c *UTXOCache) Best() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.best
+}
+
+func (c *UTXOCache) SetBest(hash []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.best = hash
+}
+
+// block hash the UTXO set on disk reflects
+func (c *UTXOCache) FlushedBest() []byte {
+	best, err := c.db.Get(utxoBestKey, nil)
+	if err != nil {
+		return nil
+	}
+	return best
+}
+
+// write every change and the best block in one batch
+func (c *UTXOCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for key, entry := range c.entries {
+		if !entry.dirty {
+			continue
+		}
+		if entry.value == nil {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), entry.value)
+		}
+	}
+	if c.best != nil {
+		batch.Put(utxoBestKey, c.best)
+	}
+	HandleErr(c.db.Write(batch, nil))
+
+	c.entries = make(map[string]*cacheEntry)
+	c.size = 0
+}
+
+func (c *UTXOCache) FlushIfFull() {
+	c.mu.Lock()
+	full := c.size > UTXOCacheBudget
+	c.mu.Unlock()
+
+	if full {
+		c.Flush()
+	}
+}
+
+// forget pending changes after the set was rewritten on disk
+func (c *UTXOCache) Reset(best []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*cacheEntry)
+	c.size = 0
+	c.best = best
+}
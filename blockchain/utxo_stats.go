@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type UTXOStats struct {
+	Height         int64
+	BestBlock      []byte
+	Outputs        int
+	Transactions   int
+	TotalValue     int
+	SerializedSize int
+	Hash           []byte
+}
+
+// feed one output to the set hash in a fixed layout independent of gob
+func hashUTXO(hasher hash.Hash, key []byte, utxo *UnspentOutput) {
+	txID, outIdx := splitUTXOKey(key)
+	buf := make([]byte, 8)
+
+	hasher.Write(txID)
+	binary.BigEndian.PutUint32(buf[:4], uint32(outIdx))
+	hasher.Write(buf[:4])
+
+	binary.BigEndian.PutUint64(buf, uint64(utxo.Height))
+	hasher.Write(buf)
+	if utxo.Coinbase {
+		hasher.Write([]byte{1})
+	} else {
+		hasher.Write([]byte{0})
+	}
+
+	binary.BigEndian.PutUint64(buf, uint64(utxo.Output.Value))
+	hasher.Write(buf)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(utxo.Output.PublicKeyHash)))
+	hasher.Write(buf[:4])
+	hasher.Write(utxo.Output.PublicKeyHash)
+}
+
+// statistics and a deterministic hash of the set at the current tip
+func (u UTXOSet) Stats() UTXOStats {
+	var stats UTXOStats
+	var lastID []byte
+	hasher := sha256.New()
+
+	snap, _ := u.BlockChain.utxoSnapshot()
+	defer snap.Release()
+	stats.BestBlock, _ = snap.Get(utxoBestKey, nil)
+	if block, err := u.BlockChain.GetBlockByHash(stats.BestBlock); err == nil {
+		stats.Height = block.Height
+	}
+
+	// keys are sorted, so the hash doesn't depend on insertion order
+	it := snap.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		utxo := Bytes2UnspentOutput(it.Value())
+		txID, _ := splitUTXOKey(it.Key())
+
+		stats.Outputs++
+		if string(txID) != string(lastID) {
+			stats.Transactions++
+			lastID = append([]byte{}, txID...)
+		}
+		stats.TotalValue += utxo.Output.Value
+		stats.SerializedSize += len(it.Key()) + len(it.Value())
+
+		hashUTXO(hasher, it.Key(), &utxo)
+	}
+	HandleErr(it.Error())
+	stats.Hash = hasher.Sum(nil)
+
+	return stats
+}
+
+// same hash as Stats for a set held in memory
+func HashUTXOMap(UTXO map[string]UnspentOutput) []byte {
+	var keys []string
+	hasher := sha256.New()
+
+	for key := range UTXO {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		utxo := UTXO[key]
+		hashUTXO(hasher, []byte(key), &utxo)
+	}
+	return hasher.Sum(nil)
+}
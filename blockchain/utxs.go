@@ -2,56 +2,135 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"fmt"
+	"log"
 
 	"github.com/dgraph-io/badger"
+	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
-	utxoPrefix   = []byte("utxo-")
-	prefixLength = len(utxoPrefix)
+	utxoPrefix     = []byte("utxo-")
+	prefixLength   = len(utxoPrefix)
+	undoPrefix     = []byte("undo-")
+	utxoVersionKey = []byte("utxoversion")
 )
 
+// bumped whenever UTXO or undo entries are stored differently, 2 keys them by outpoint
+const utxoVersion = 2
+
 type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
+// state of a UTXO entry before a block touched it
+type UndoEntry struct {
+	Key     []byte
+	Value   []byte
+	Existed bool
+}
+
+type BlockUndo struct {
+	Entries []UndoEntry
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
+
+func (undo *BlockUndo) ToBytes() []byte {
+	var buffer bytes.Buffer
+
+	encode := gob.NewEncoder(&buffer)
+	HandleErr(encode.Encode(undo))
+
+	return buffer.Bytes()
+}
+
+func Bytes2BlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	HandleErr(decoder.Decode(&undo))
+	return undo
+}
+
+// key is utxoPrefix | txid | vout
+func utxoKey(txID []byte, out int) []byte {
+	key := make([]byte, 0, prefixLength+len(txID)+4)
+	key = append(key, utxoPrefix...)
+	key = append(key, txID...)
+
+	vout := make([]byte, 4)
+	binary.BigEndian.PutUint32(vout, uint32(out))
+
+	return append(key, vout...)
+}
+
+func splitUTXOKey(key []byte) ([]byte, int) {
+	key = bytes.TrimPrefix(key, utxoPrefix)
+	split := len(key) - 4
+
+	return key[:split], int(binary.BigEndian.Uint32(key[split:]))
+}
+
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 
-	// create new iterator
-	db := u.BlockChain.Database
-	it := db.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	// scans read the disk, so write back pending changes first
+	snap, tip := u.BlockChain.utxoSnapshot()
+	defer snap.Release()
+	it := snap.NewIterator(util.BytesPrefix(utxoPrefix), nil)
 	defer it.Release()
 
-	for it.Next() {
-		k := it.Key()
-		v := it.Value()
-		k = bytes.TrimPrefix(k, utxoPrefix)
-
-		txID := hex.EncodeToString(k)
-		outs := Bytes2Txoutputs(v)
+	// outputs must be mature in the next block
+	height := tip + 1
 
-		for outIdx, out := range outs.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-			}
+	for it.Next() && accumulated < amount {
+		utxo := Bytes2UnspentOutput(it.Value())
+		if !utxo.Output.IsLockedWithKey(pubKeyHash) || !utxo.IsMature(height) {
+			continue
 		}
+
+		txID, outIdx := splitUTXOKey(it.Key())
+		key := hex.EncodeToString(txID)
+
+		accumulated += utxo.Output.Value
+		unspentOuts[key] = append(unspentOuts[key], outIdx)
 	}
 	return accumulated, unspentOuts
 }
 
+// single output lookup without touching the rest of the transaction
+func (u UTXOSet) GetUTXO(txID []byte, out int) (UnspentOutput, error) {
+	value, ok := u.BlockChain.cache.Get(utxoKey(txID, out))
+	if !ok {
+		return UnspentOutput{}, leveldb.ErrNotFound
+	}
+	return Bytes2UnspentOutput(value), nil
+}
+
+// number of transactions with at least one unspent output
 func (u UTXOSet) CountTransactions() int {
-	db := u.BlockChain.Database
+	snap, _ := u.BlockChain.utxoSnapshot()
+	defer snap.Release()
 	counter := 0
 
-	it := db.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	it := snap.NewIterator(util.BytesPrefix(utxoPrefix), nil)
 	defer it.Release()
+
+	// keys are sorted, so outputs of a transaction are adjacent
+	var lastID []byte
 	for it.Next() {
-		counter++
+		txID, _ := splitUTXOKey(it.Key())
+		if !bytes.Equal(txID, lastID) {
+			counter++
+			lastID = append([]byte{}, txID...)
+		}
 	}
 
 	return counter
@@ -61,76 +140,205 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOut {
 	var UTXOs []TxOut
 
 	// create leveldb iterator
-	db := u.BlockChain.Database
-	it := db.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	snap, _ := u.BlockChain.utxoSnapshot()
+	defer snap.Release()
+	it := snap.NewIterator(util.BytesPrefix(utxoPrefix), nil)
 	defer it.Release()
 
 	// iterate through values of prefix "utxoPrefix"
 	for it.Next() {
+		utxo := Bytes2UnspentOutput(it.Value())
 
-		v := it.Value()
-		outs := Bytes2Txoutputs(v)
-
-		for _, out := range outs.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
-			}
+		if utxo.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, utxo.Output)
 		}
 	}
 	return UTXOs
 }
+
+// split balance into spendable and immature coinbase value
+func (u UTXOSet) FindBalance(pubKeyHash []byte) (spendable, immature int) {
+	snap, tip := u.BlockChain.utxoSnapshot()
+	defer snap.Release()
+	it := snap.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	defer it.Release()
+
+	height := tip + 1
+
+	for it.Next() {
+		utxo := Bytes2UnspentOutput(it.Value())
+
+		if !utxo.Output.IsLockedWithKey(pubKeyHash) {
+			continue
+		}
+		if utxo.IsMature(height) {
+			spendable += utxo.Output.Value
+		} else {
+			immature += utxo.Output.Value
+		}
+	}
+	return spendable, immature
+}
+
+// reject transactions spending coinbase outputs before maturity
+func (u UTXOSet) CheckMaturity(tx *Tx, height int64) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for _, in := range tx.Inputs {
+		utxo, err := u.GetUTXO(in.ID, in.Out)
+		if err != nil {
+			continue
+		}
+
+		if !utxo.IsMature(height) {
+			return fmt.Errorf("Coinbase %x spent at height %d before maturity (%d blocks)",
+				in.ID, height, Params.CoinbaseMaturity)
+		}
+	}
+	return nil
+}
+
 func (u UTXOSet) Reindex() {
 	db := u.BlockChain.Database
 
+	// pruned or missing blocks can't be replayed
+	if !u.BlockChain.CanReindex() {
+		log.Panic("Cannot reindex without the full chain history")
+	}
+
+	// pending changes are about to be replaced
+	u.BlockChain.cache.Reset(nil)
 	u.DeleteByPrefix(utxoPrefix)
 	UTXO := u.BlockChain.FindUTXO()
 
 	// refresh database
-	for txId, outs := range UTXO {
-		key, err := hex.DecodeString(txId)
-		HandleErr(err)
-		key = append(utxoPrefix, key...)
+	batch := new(leveldb.Batch)
+	for key, utxo := range UTXO {
+		batch.Put([]byte(key), utxo.ToBytes())
+	}
+
+	lastBlock, err := u.BlockChain.GetLastBlock()
+	if err == nil {
+		batch.Put(utxoBestKey, lastBlock.Hash)
+		u.BlockChain.cache.Reset(lastBlock.Hash)
+	}
+	batch.Put(utxoVersionKey, ToBytes(utxoVersion))
+	HandleErr(db.Write(batch, nil))
+}
+
+// rebuild a UTXO set stored in an older format, undo data in it can't be applied
+func (u UTXOSet) CheckVersion() {
+	db := u.BlockChain.Database
+
+	stored := int64(1) // written before the format was versioned
+	if data, err := db.Get(utxoVersionKey, nil); err == nil {
+		stored = int64(binary.BigEndian.Uint64(data))
+	}
+	if stored == utxoVersion {
+		return
+	}
+
+	// an empty chain has nothing in the old format
+	if _, err := u.BlockChain.GetLastBlock(); err != nil {
+		HandleErr(db.Put(utxoVersionKey, ToBytes(utxoVersion), nil))
+		return
+	}
 
-		err = db.Put(key, outs.ToBytes(), nil)
-		HandleErr(err)
+	if !u.BlockChain.CanReindex() {
+		log.Panicf("UTXO set format %d needs a reindex to %d, which needs the full chain history", stored, utxoVersion)
 	}
+	fmt.Printf("UTXO set format %d is outdated, reindexing to %d\n", stored, utxoVersion)
+	u.DeleteByPrefix(undoPrefix)
+	u.Reindex()
+}
+
+// block the UTXO set currently reflects
+func (u UTXOSet) BestBlock() []byte {
+	return u.BlockChain.cache.Best()
 }
 
 func (u *UTXOSet) Update(block *Block) {
 	db := u.BlockChain.Database
+	cache := u.BlockChain.cache
+	undo := BlockUndo{}
+	touched := make(map[string]bool)
+
+	// remember entries before their first change
+	record := func(key []byte) {
+		if touched[string(key)] {
+			return
+		}
+		touched[string(key)] = true
+
+		value, ok := cache.Get(key)
+		entry := UndoEntry{Key: append([]byte{}, key...), Existed: ok}
+		if ok {
+			entry.Value = value
+		}
+		undo.Entries = append(undo.Entries, entry)
+	}
 
 	for _, tx := range block.Txs {
 		if tx.IsCoinbase() == false {
 			for _, in := range tx.Inputs {
-				updatedOuts := TxOutputs{}
-				inID := append(utxoPrefix, in.ID...)
-
-				value, err := db.Get(inID, nil) // problem
-				//				if strings.Contains(err.Error(), "leveldb: not found")
-				HandleErr(err)
-				outs := Bytes2Txoutputs(value)
-
-				for outIdx, out := range outs.Outputs {
-					if outIdx != in.Out {
-						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-					}
-				}
-				if len(updatedOuts.Outputs) == 0 {
-					HandleErr(db.Delete(inID, nil))
-				} else {
-					HandleErr(db.Put(inID, updatedOuts.ToBytes(), nil))
+				key := utxoKey(in.ID, in.Out)
+
+				// spent output must exist
+				if _, ok := cache.Get(key); !ok {
+					log.Panicf("Input %x:%d is not in the UTXO set", in.ID, in.Out)
 				}
+
+				record(key)
+				cache.Delete(key)
 			}
 		}
 
-		newOutputs := TxOutputs{}
-		for _, out := range tx.Outputs {
-			newOutputs.Outputs = append(newOutputs.Outputs, out)
+		for outIdx, out := range tx.Outputs {
+
+			// data carriers never enter the set
+			if out.IsDataCarrier() {
+				continue
+			}
+
+			key := utxoKey(tx.ID, outIdx)
+			utxo := UnspentOutput{out, block.Height, tx.IsCoinbase()}
+
+			record(key)
+			cache.Put(key, utxo.ToBytes())
 		}
+	}
+	HandleErr(db.Put(undoKey(block.Hash), undo.ToBytes(), nil))
+
+	cache.SetBest(block.Hash)
+	cache.FlushIfFull()
+}
 
-		txID := append(utxoPrefix, tx.ID...)
-		HandleErr(db.Put(txID, newOutputs.ToBytes(), nil))
+// roll the set back to before block was applied
+func (u *UTXOSet) Undo(block *Block) {
+	db := u.BlockChain.Database
+	cache := u.BlockChain.cache
+
+	data, err := db.Get(undoKey(block.Hash), nil)
+	if err != nil {
+		log.Panicf("No undo data for block %x", block.Hash)
 	}
+	undo := Bytes2BlockUndo(data)
+
+	for i := len(undo.Entries) - 1; i >= 0; i-- {
+		entry := undo.Entries[i]
+		if entry.Existed {
+			cache.Put(entry.Key, entry.Value)
+		} else {
+			cache.Delete(entry.Key)
+		}
+	}
+	cache.SetBest(block.PrevHash)
+
+	// undo data must outlive the changes it reverts
+	cache.Flush()
+	HandleErr(db.Delete(undoKey(block.Hash), nil))
 }
 
 func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
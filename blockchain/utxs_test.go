@@ -0,0 +1,173 @@
+package blockchain
+
+import (
+	"bytes"
+	"exx/gochain/wallet"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// the UTXO set on disk, after pending changes are flushed
+func storedUTXOs(chain *BlockChain) map[string]string {
+	stored, _ := chain.utxoSnapshot()
+	defer stored.Release()
+
+	utxos := make(map[string]string)
+	it := stored.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	for it.Next() {
+		utxos[string(it.Key())] = string(it.Value())
+	}
+	it.Release()
+	HandleErr(it.Error())
+
+	return utxos
+}
+
+// the stored set must be the one replayed from the main chain
+func checkUTXOSet(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	replayed := make(map[string]string)
+	for key, utxo := range chain.FindUTXO() {
+		replayed[key] = string(utxo.ToBytes())
+	}
+	if stored := storedUTXOs(chain); !reflect.DeepEqual(stored, replayed) {
+		t.Fatalf("UTXO set has %d entries, the main chain %d", len(stored), len(replayed))
+	}
+}
+
+func TestUTXOUpdateUndo(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+	before := storedUTXOs(chain)
+
+	genesis, err := chain.GetLastBlock()
+	HandleErr(err)
+	tx := NewTx(w, string(wallet.MakeWallet().GetAddress()), 1, &UTXOSet{BlockChain: chain})
+	mineBlock(t, chain, w, tx)
+	checkUTXOSet(t, chain)
+
+	u := UTXOSet{BlockChain: chain}
+	if _, err := u.GetUTXO(genesis.Txs[0].ID, 0); err == nil {
+		t.Fatal("spent genesis output still in the set")
+	}
+	if _, err := u.GetUTXO(tx.ID, 0); err != nil {
+		t.Fatal("new output missing from the set")
+	}
+
+	if err := chain.disconnectTip(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(storedUTXOs(chain), before) {
+		t.Fatal("undo did not restore the set before the block")
+	}
+}
+
+// a longer branch without the spend takes over and the spend is rolled back
+func TestReorgUTXO(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.GetAddress())
+	chain := testChain(t, w)
+
+	genesis, err := chain.GetLastBlock()
+	HandleErr(err)
+	tx := NewTx(w, string(wallet.MakeWallet().GetAddress()), 1, &UTXOSet{BlockChain: chain})
+	mineBlock(t, chain, w, tx)
+
+	parent := &genesis
+	for i := 0; i < 2; i++ {
+		coinbase := CoinbaseTx(address, fmt.Sprintf("branch %d", i))
+		block := chain.CreateBlock([]*Tx{coinbase}, parent.Hash, parent.Height+1)
+		if _, err := chain.ProcessBlock(block); err != nil {
+			t.Fatalf("branch block %d rejected: %s", block.Height, err)
+		}
+		parent = block
+	}
+
+	tip, err := chain.GetLastBlock()
+	HandleErr(err)
+	if !bytes.Equal(tip.Hash, parent.Hash) {
+		t.Fatal("longer branch is not the main chain")
+	}
+	checkUTXOSet(t, chain)
+
+	u := UTXOSet{BlockChain: chain}
+	if _, err := u.GetUTXO(genesis.Txs[0].ID, 0); err != nil {
+		t.Fatal("output spent on the old branch is not back in the set")
+	}
+	if _, err := u.GetUTXO(tx.ID, 0); err == nil {
+		t.Fatal("output of the old branch still in the set")
+	}
+}
+
+// blocks connected since the last flush are replayed when the chain is opened
+func TestUTXOCacheRecovery(t *testing.T) {
+	w := wallet.MakeWallet()
+	nodeID := t.Name()
+	os.RemoveAll(fmt.Sprintf(DBPath, nodeID))
+
+	chain := ContinueBlockChain(nodeID)
+	chain.CreateBlockChain(string(w.GetAddress()), nodeID)
+	UTXOSet{BlockChain: chain}.Reindex()
+
+	tx := NewTx(w, string(wallet.MakeWallet().GetAddress()), 1, &UTXOSet{BlockChain: chain})
+	mineBlock(t, chain, w, tx)
+	tip := mineBlock(t, chain, w)
+	if bytes.Equal(chain.cache.FlushedBest(), tip.Hash) {
+		t.Fatal("blocks flushed before the crash")
+	}
+
+	// crash without flushing the cache
+	chain.Database.Close()
+
+	chain = ContinueBlockChain(nodeID)
+	defer chain.Close()
+
+	if !bytes.Equal(chain.cache.FlushedBest(), tip.Hash) {
+		t.Fatal("recovered UTXO set is not at the tip")
+	}
+	checkUTXOSet(t, chain)
+}
+
+// wallet style scans run while blocks are connected, run with -race
+func TestConcurrentReads(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := testChain(t, w)
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			u := UTXOSet{BlockChain: chain}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				chain.GetBestHeight()
+				u.FindBalance(pubKeyHash)
+				u.CountTransactions()
+				u.Stats()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		tx := NewTx(w, string(wallet.MakeWallet().GetAddress()), 1, &UTXOSet{BlockChain: chain})
+		mineBlock(t, chain, w, tx)
+	}
+	close(done)
+	readers.Wait()
+
+	checkUTXOSet(t, chain)
+}
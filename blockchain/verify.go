@@ -0,0 +1,220 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// each level includes the checks of the levels below it
+const (
+	VerifyDecode     = iota // every stored block decodes
+	VerifyHeaders           // difficulty, proof of work, prev-hash linkage and heights
+	VerifyMerkle            // merkle roots match the transactions
+	VerifySignatures        // every transaction signature verifies
+	VerifyUTXO              // rebuilt UTXO set matches the stored one
+)
+
+type VerifyError struct {
+	Height int64
+	Hash   []byte
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("block %x at height %d: %s", e.Hash, e.Height, e.Reason)
+}
+
+func failAt(block *Block, format string, args ...interface{}) error {
+	return &VerifyError{block.Height, block.Hash, fmt.Sprintf(format, args...)}
+}
+
+// ids are taken before inputs are signed
+func unsignedHash(tx *Tx) []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxIn, len(tx.Inputs))
+
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxIn{in.ID, in.Out, nil, in.PubKey}
+	}
+	return txCopy.Hash()
+}
+
+// load the stored chain tip first without panicking on bad data
+func (chain *BlockChain) readChain() ([]*Block, error) {
+	var blocks []*Block
+
+	currHash, err := chain.Database.Get([]byte("lh"), nil)
+	if err != nil {
+		return nil, err
+	}
+	height := int64(-1)
+
+	for currHash != nil {
+		data, err := chain.Database.Get(currHash, nil)
+
+		// history below a snapshot may still be back-filling
+		if err == leveldb.ErrNotFound && bytes.Equal(currHash, chain.BackfillHash()) {
+			break
+		}
+		if err != nil && len(blocks) == 0 {
+			return nil, fmt.Errorf("tip block %x is missing: %s", currHash, err)
+		}
+		if err != nil {
+			return nil, &VerifyError{height - 1, currHash, fmt.Sprintf("block is missing: %s", err)}
+		}
+
+		var block Block
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
+			if len(blocks) == 0 {
+				return nil, fmt.Errorf("tip block %x does not decode: %s", currHash, err)
+			}
+			return nil, &VerifyError{height - 1, currHash, fmt.Sprintf("block does not decode: %s", err)}
+		}
+		if !bytes.Equal(block.Hash, currHash) {
+			return nil, failAt(&block, "stored under hash %x", currHash)
+		}
+
+		blocks = append(blocks, &block)
+		height = block.Height
+		currHash = block.PrevHash
+	}
+
+	// genesis first
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks, nil
+}
+
+// check the stored chain up to level, returning the first failure
+func (chain *BlockChain) VerifyChain(level int) (int, error) {
+	blocks, err := chain.readChain()
+	if err != nil || level < VerifyHeaders {
+		return len(blocks), err
+	}
+
+	// transaction checks need every block body
+	if level > VerifyMerkle && !chain.CanReindex() {
+		return len(blocks), fmt.Errorf("Level %d needs the full chain history", level)
+	}
+
+	prunedHeight := chain.PrunedHeight()
+	txs := make(map[string]Tx)
+	UTXO := make(map[string]UnspentOutput)
+
+	for i, block := range blocks {
+
+		// headers
+		var parent *Block
+		if i > 0 {
+			parent = blocks[i-1]
+		}
+		if block.PrevHash == nil || parent != nil {
+			if err := CheckDifficulty(parent, block); err != nil {
+				return i, failAt(block, "%s", err)
+			}
+		}
+		if !NewProof(block).Validate() {
+			return i, failAt(block, "proof of work is invalid")
+		}
+		if i == 0 {
+			if block.PrevHash == nil && block.Height != 0 {
+				return i, failAt(block, "genesis block has height %d", block.Height)
+			}
+		} else {
+			prev := blocks[i-1]
+			if !bytes.Equal(block.PrevHash, prev.Hash) {
+				return i, failAt(block, "prev hash %x does not link to %x", block.PrevHash, prev.Hash)
+			}
+			if block.Height != prev.Height+1 {
+				return i, failAt(block, "height does not follow %d", prev.Height)
+			}
+		}
+		if level < VerifyMerkle || block.Height <= prunedHeight {
+			continue
+		}
+
+		// merkle root
+		if len(block.Txs) == 0 {
+			return i, failAt(block, "block has no transactions")
+		}
+		if err := block.CheckMerkleRoot(); err != nil {
+			return i, failAt(block, "%s", err)
+		}
+		if level < VerifySignatures {
+			continue
+		}
+
+		for _, tx := range block.Txs {
+			txID := hex.EncodeToString(tx.ID)
+			if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+				return i, failAt(block, "transaction %x has the wrong id", tx.ID)
+			}
+
+			// signatures
+			prevTXs := make(map[string]Tx)
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					prevTX, ok := txs[hex.EncodeToString(in.ID)]
+					if !ok || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+						return i, failAt(block, "transaction %x spends unknown output %x:%d", tx.ID, in.ID, in.Out)
+					}
+					if prevTX.Outputs[in.Out].IsDataCarrier() {
+						return i, failAt(block, "transaction %x spends a data carrier", tx.ID)
+					}
+					prevTXs[hex.EncodeToString(in.ID)] = prevTX
+				}
+			}
+			for _, out := range tx.Outputs {
+				if out.IsDataCarrier() && !out.IsValidDataCarrier() {
+					return i, failAt(block, "transaction %x has an invalid data carrier", tx.ID)
+				}
+			}
+			if !tx.Verify(prevTXs) {
+				return i, failAt(block, "transaction %x has an invalid signature", tx.ID)
+			}
+			txs[txID] = *tx
+
+			if level < VerifyUTXO {
+				continue
+			}
+
+			// rebuild the UTXO set
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					key := string(utxoKey(in.ID, in.Out))
+					utxo, ok := UTXO[key]
+					if !ok {
+						return i, failAt(block, "transaction %x double spends %x:%d", tx.ID, in.ID, in.Out)
+					}
+					if !utxo.IsMature(block.Height) {
+						return i, failAt(block, "transaction %x spends immature coinbase %x", tx.ID, in.ID)
+					}
+					delete(UTXO, key)
+				}
+			}
+			for outIdx, out := range tx.Outputs {
+				if !out.IsDataCarrier() {
+					UTXO[string(utxoKey(tx.ID, outIdx))] = UnspentOutput{out, block.Height, tx.IsCoinbase()}
+				}
+			}
+		}
+	}
+
+	if level >= VerifyUTXO && len(blocks) > 0 {
+		tip := blocks[len(blocks)-1]
+		stats := UTXOSet{BlockChain: chain}.Stats()
+
+		if !bytes.Equal(stats.BestBlock, tip.Hash) {
+			return len(blocks), failAt(tip, "UTXO set is at block %x, not the tip", stats.BestBlock)
+		}
+		if !bytes.Equal(stats.Hash, HashUTXOMap(UTXO)) {
+			return len(blocks), failAt(tip, "stored UTXO set does not match the chain")
+		}
+	}
+	return len(blocks), nil
+}
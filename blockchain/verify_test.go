@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"exx/gochain/wallet"
+	"testing"
+)
+
+// each level catches a corruption the levels below it miss
+func TestVerifyChainLevels(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   int
+		height  int64
+		corrupt func(chain *BlockChain, blocks []*Block)
+	}{
+		{"decode", VerifyDecode, 1, func(chain *BlockChain, blocks []*Block) {
+			HandleErr(chain.Database.Put(blocks[1].Hash, []byte("not a block"), nil))
+		}},
+		{"headers", VerifyHeaders, 1, func(chain *BlockChain, blocks []*Block) {
+			blocks[1].Nonce++
+			HandleErr(chain.Database.Put(blocks[1].Hash, blocks[1].ToBytes(), nil))
+		}},
+		{"merkle", VerifyMerkle, 1, func(chain *BlockChain, blocks []*Block) {
+			coinbase := *blocks[1].Txs[1]
+			coinbase.Outputs = []TxOut{{Value: 1000, PublicKeyHash: coinbase.Outputs[0].PublicKeyHash}}
+			blocks[1].Txs[1] = &coinbase
+			HandleErr(chain.Database.Put(blocks[1].Hash, blocks[1].ToBytes(), nil))
+		}},
+		{"signatures", VerifySignatures, 2, func(chain *BlockChain, blocks []*Block) {
+
+			// a forged signature in a tip that commits to it and is mined again
+			tip := blocks[2]
+			tx := *tip.Txs[0]
+			tx.Inputs = append([]TxIn{}, tx.Inputs...)
+			tx.Inputs[0].Sig = append([]byte{}, tx.Inputs[0].Sig...)
+			tx.Inputs[0].Sig[0] ^= 1
+			tip.Txs[0] = &tx
+			tip.MerkleRoot = tip.HashTxs()
+			tip.Nonce, tip.Hash = NewProof(tip).Run()
+			HandleErr(chain.Database.Put(tip.Hash, tip.ToBytes(), nil))
+			HandleErr(chain.Database.Put([]byte("lh"), tip.Hash, nil))
+		}},
+		{"utxo", VerifyUTXO, 2, func(chain *BlockChain, blocks []*Block) {
+			coinbase := blocks[2].Txs[1]
+			chain.FlushUTXO()
+			HandleErr(chain.Database.Delete(utxoKey(coinbase.ID, 0), nil))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := wallet.MakeWallet()
+			chain := testChain(t, w)
+
+			genesis, err := chain.GetLastBlock()
+			HandleErr(err)
+			blocks := []*Block{&genesis}
+			for i := 0; i < 2; i++ {
+				tx := NewTx(w, string(wallet.MakeWallet().GetAddress()), 1, &UTXOSet{BlockChain: chain})
+				blocks = append(blocks, mineBlock(t, chain, w, tx))
+			}
+			if _, err := chain.VerifyChain(VerifyUTXO); err != nil {
+				t.Fatalf("intact chain fails: %s", err)
+			}
+
+			test.corrupt(chain, blocks)
+			if test.level > VerifyDecode {
+				if _, err := chain.VerifyChain(test.level - 1); err != nil {
+					t.Fatalf("level %d fails: %s", test.level-1, err)
+				}
+			}
+			_, err = chain.VerifyChain(test.level)
+			verr, ok := err.(*VerifyError)
+			if !ok || verr.Height != test.height {
+				t.Fatalf("level %d returned %v, want a failure at height %d", test.level, err, test.height)
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package cli
 
 import (
+	"context"
+	"crypto/sha256"
 	"exx/gochain/blockchain"
 	"exx/gochain/network"
 	"exx/gochain/wallet"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
@@ -15,9 +21,16 @@ import (
 	death "github.com/vrecan/death/v3"
 )
 
+const broadcastTimeout = 10 * time.Second
+
 type CommandLine struct {
 	BlockChain *blockchain.BlockChain
 	nodeID     string
+	listen     string   // host:port to listen on
+	addNodes   []string // peers to connect to besides gossiped ones
+	connect    []string // the only peers to connect to
+	node       *network.Node
+	nodeMu     sync.Mutex
 }
 
 func (cli *CommandLine) printUsage() {
@@ -29,7 +42,113 @@ func (cli *CommandLine) printUsage() {
 	fmt.Println("	--createwallet               - Create new wallet")
 	fmt.Println("	--listaddresses              - List addresses in wallet file")
 	fmt.Println("	--reindexutxo                - Rebuild the UTXO set")
+	fmt.Println("	--utxosetinfo                - Print statistics and a hash of the UTXO set")
+	fmt.Println("	--verifychain [LEVEL]        - Check the stored chain (0 decode .. 4 UTXO set, default 4)")
 	fmt.Println("	--mine ADDRESS               - Start a node with mining enabled for ADDRESS")
+	fmt.Println("	--connect PEERS              - Start a node connecting only to comma separated host:port PEERS")
+	fmt.Println("	--addnode PEERS              - Start a node that also connects to comma separated PEERS")
+	fmt.Println("	--listpeers                  - List known peer addresses with when they were last seen")
+	fmt.Println("	--listbans                   - List banned peers with when their bans end")
+	fmt.Println("	--ban ADDRESS [HOURS]        - Ban ADDRESS, a host:port or a host, for HOURS (default 24)")
+	fmt.Println("	--clearbans [ADDRESS]        - Lift the ban on ADDRESS, or every ban")
+	fmt.Println("	--light                      - Start a light node following headers for the wallet's addresses")
+	fmt.Println("	--lightbalance ADDRESS       - Get the balance for ADDRESS seen by the light node")
+	fmt.Println("	--anchor FROM FILE [mine]    - Anchor the SHA-256 of FILE on chain, paid for by FROM")
+	fmt.Println("	--verifyanchor FILE          - Find the anchor for FILE and print its Merkle proof")
+	fmt.Println("	--prune DEPTH                - Keep only the last DEPTH block bodies from now on")
+	fmt.Println("	--dumputxo FILE [HEIGHT]     - Write the UTXO set at HEIGHT (default tip) to FILE")
+	fmt.Println("	--loadutxo FILE              - Start a fresh node from a trusted UTXO snapshot")
+	fmt.Println("	--export FILE [FROM [TO]]    - Write main chain blocks FROM..TO (default all) to FILE")
+	fmt.Println("	--import FILE                - Validate and connect the blocks in a bootstrap FILE")
+	fmt.Println("Environment:")
+	fmt.Println("	NODE_ID                      - Node identifier, required")
+	fmt.Println("	NETWORK                      - main (default) or test, nodes only talk within a network")
+	fmt.Println("	LISTEN                       - host:port to listen on, default the first free port in ./ports")
+	fmt.Println("	ADDNODE                      - Comma separated peers to connect to, as --addnode")
+	fmt.Println("	CONNECT                      - Comma separated peers to connect to exclusively, as --connect")
+	fmt.Println("	COINBASE_MATURITY            - Blocks before a coinbase can be spent")
+	fmt.Println("	ASSUME_UTXO                  - Trusted snapshot as HEIGHT:HASH")
+	fmt.Println("	UTXO_CACHE_MB                - Memory for cached UTXO changes before a flush")
+	fmt.Println("	CHECKPOINTS                  - Extra checkpoints as HEIGHT:HASH,HEIGHT:HASH")
+	fmt.Println("	MERKLE_ROOT_HEIGHT           - First height whose headers must commit to transactions (default 0)")
+}
+
+// override chain parameters and node settings from the environment
+func loadParams() {
+	switch os.Getenv("NETWORK") {
+	case "", "main":
+		network.Magic = network.MainNetMagic
+	case "test":
+		network.Magic = network.TestNetMagic
+	default:
+		log.Panic("NETWORK must be main or test")
+	}
+	if maturity := os.Getenv("COINBASE_MATURITY"); maturity != "" {
+		depth, err := strconv.ParseInt(maturity, 10, 64)
+		HandleErr(err)
+		blockchain.Params.CoinbaseMaturity = depth
+	}
+	if size := os.Getenv("UTXO_CACHE_MB"); size != "" {
+		mb, err := strconv.Atoi(size)
+		HandleErr(err)
+		blockchain.UTXOCacheBudget = mb << 20
+	}
+	if snapshot := os.Getenv("ASSUME_UTXO"); snapshot != "" {
+		height, hash := parseHeightHash("ASSUME_UTXO", snapshot)
+		blockchain.Params.AssumeUTXO[height] = hash
+	}
+	if height := os.Getenv("MERKLE_ROOT_HEIGHT"); height != "" {
+		activation, err := strconv.ParseInt(height, 10, 64)
+		HandleErr(err)
+		blockchain.Params.MerkleRootHeight = activation
+	}
+	if checkpoints := os.Getenv("CHECKPOINTS"); checkpoints != "" {
+		for _, checkpoint := range strings.Split(checkpoints, ",") {
+			height, hash := parseHeightHash("CHECKPOINTS", checkpoint)
+			blockchain.Params.Checkpoints[height] = hash
+		}
+	}
+}
+
+// where and to whom a started node connects
+func (cli *CommandLine) loadPeerConfig() {
+	cli.listen = os.Getenv("LISTEN")
+	cli.addNodes = splitPeers(os.Getenv("ADDNODE"))
+	cli.connect = splitPeers(os.Getenv("CONNECT"))
+}
+
+func splitPeers(value string) []string {
+	var peers []string
+	for _, peer := range strings.Split(value, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (cli *CommandLine) nodeOptions() []network.Option {
+	opts := []network.Option{
+		network.WithListenAddress(cli.listen),
+		network.WithPeerFile(fmt.Sprintf(network.PeersPath, cli.nodeID)),
+		network.WithBanFile(fmt.Sprintf(network.BansPath, cli.nodeID)),
+		network.WithPeers(cli.addNodes...),
+	}
+	if len(cli.connect) > 0 {
+		opts = append(opts, network.WithConnect(cli.connect...))
+	}
+	return opts
+}
+
+func parseHeightHash(name, value string) (int64, string) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		log.Panicf("%s must be HEIGHT:HASH", name)
+	}
+	height, err := strconv.ParseInt(parts[0], 10, 64)
+	HandleErr(err)
+
+	return height, strings.ToLower(parts[1])
 }
 
 func (cli *CommandLine) createBlockChain(address string) {
@@ -54,7 +173,107 @@ func (cli *CommandLine) startNode(minerAddress string) {
 			log.Panic("Invalid address")
 		}
 	}
-	network.StartP2P(cli.BlockChain, minerAddress)
+	opts := append(cli.nodeOptions(),
+		network.WithChain(cli.BlockChain),
+		network.WithMinerAddress(minerAddress),
+	)
+	cli.runNode(network.NewNode(opts...))
+}
+
+// sync headers and filters only, tracking the wallet's addresses
+func (cli *CommandLine) startLight() {
+	fmt.Printf("Starting light node %s\n", cli.nodeID)
+
+	wallets, err := wallet.CreateWallets(cli.nodeID)
+	if os.IsNotExist(err) {
+		log.Panic("No wallets")
+	}
+
+	var pubKeyHashes [][]byte
+	for _, address := range wallets.GetAllAddresses() {
+		pubKeyHash := wallet.Base58Decode([]byte(address))
+		pubKeyHashes = append(pubKeyHashes, pubKeyHash[1:len(pubKeyHash)-4])
+	}
+
+	light := blockchain.OpenLightChain(cli.nodeID)
+	defer light.Close()
+
+	cli.runNode(network.NewNode(append(cli.nodeOptions(), network.WithLight(light, pubKeyHashes))...))
+}
+
+func (cli *CommandLine) listPeers() {
+	peers, err := network.LoadPeers(fmt.Sprintf(network.PeersPath, cli.nodeID))
+	HandleErr(err)
+
+	for _, peer := range peers {
+		lastSeen := "never"
+		if peer.LastSeen > 0 {
+			lastSeen = time.Unix(peer.LastSeen, 0).Format(time.RFC3339)
+		}
+		latency := "-"
+		if peer.Latency > 0 {
+			latency = peer.Latency.Round(time.Millisecond).String()
+		}
+		fmt.Printf("%-24s seen %-25s %3d ok %3d failed %8s  %s %s\n", peer.Addr, lastSeen, peer.Successes, peer.Failures, latency, peer.UserAgent, peer.Services)
+	}
+	fmt.Printf("%d known peers\n", len(peers))
+}
+
+func (cli *CommandLine) listBans() {
+	bans, err := network.LoadBans(fmt.Sprintf(network.BansPath, cli.nodeID))
+	HandleErr(err)
+
+	for _, ban := range bans {
+		until := time.Unix(ban.Until, 0).Format(time.RFC3339)
+		fmt.Printf("%-24s until %-25s %s\n", ban.Addr, until, ban.Reason)
+	}
+	fmt.Printf("%d banned peers\n", len(bans))
+}
+
+// a running node drops the peer at its next scan
+func (cli *CommandLine) ban(address, hours string) {
+	duration := network.BanDuration
+	if hours != "" {
+		num, err := strconv.ParseFloat(hours, 64)
+		HandleErr(err)
+		duration = time.Duration(num * float64(time.Hour))
+	}
+
+	HandleErr(network.AddBan(fmt.Sprintf(network.BansPath, cli.nodeID), address, duration, "banned from the command line"))
+	fmt.Printf("Banned %s for %s\n", address, duration)
+}
+
+func (cli *CommandLine) clearBans(address string) {
+	cleared, err := network.ClearBans(fmt.Sprintf(network.BansPath, cli.nodeID), address)
+	HandleErr(err)
+
+	fmt.Printf("Lifted %d bans\n", cleared)
+}
+
+func (cli *CommandLine) lightBalance(address string) {
+	checkAddress(address)
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4] // remove version and checksum
+
+	light := blockchain.OpenLightChain(cli.nodeID)
+	defer light.Close()
+
+	balance, immature := 0, 0
+	for _, out := range light.Outputs(pubKeyHash) {
+		fmt.Printf("%x:%d %5d coins, %d confirmations\n", out.TxID, out.Out, out.Value, out.Confirmations)
+
+		// spendable in the next block
+		if out.Coinbase && out.Confirmations < blockchain.Params.CoinbaseMaturity {
+			immature += out.Value
+		} else {
+			balance += out.Value
+		}
+	}
+
+	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Immature coinbase: %d\n", immature)
+	fmt.Printf("Headers to height %d, filters scanned to %d\n", light.BestHeight(), light.ScanHeight())
 }
 
 func (cli *CommandLine) getBalance(address string) {
@@ -64,19 +283,19 @@ func (cli *CommandLine) getBalance(address string) {
 		BlockChain: cli.BlockChain,
 	}
 
-	balance := 0
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4] // remove version and checksum
-	UTXOs := UTXOst.FindUTXO(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance, immature := UTXOst.FindBalance(pubKeyHash)
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Immature coinbase: %d\n", immature)
 }
 
 func (cli *CommandLine) reindexUTXO() {
+	if !cli.BlockChain.CanReindex() {
+		fmt.Println("Cannot reindex without the full chain history")
+		return
+	}
 
 	UTXOst := blockchain.UTXOSet{
 		BlockChain: cli.BlockChain,
@@ -87,6 +306,108 @@ func (cli *CommandLine) reindexUTXO() {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CommandLine) prune(num string) {
+	depth, err := strconv.ParseInt(num, 10, 64)
+	HandleErr(err)
+
+	cli.BlockChain.EnablePruning(depth)
+	height := cli.BlockChain.Prune()
+
+	if height < 0 {
+		fmt.Printf("Pruning enabled, keeping the last %d blocks\n", depth)
+	} else {
+		fmt.Printf("Pruned block bodies up to height %d\n", height)
+	}
+}
+
+func (cli *CommandLine) dumpUTXO(file string, args []string) {
+	height := cli.BlockChain.GetBestHeight()
+	if len(args) > 0 {
+		h, err := strconv.ParseInt(args[0], 10, 64)
+		HandleErr(err)
+		height = h
+	}
+
+	UTXOst := blockchain.UTXOSet{
+		BlockChain: cli.BlockChain,
+	}
+	snap := UTXOst.DumpSnapshot(file, height)
+
+	fmt.Printf("Wrote %d UTXO entries at height %d to %s\n", len(snap.Entries), snap.Height, file)
+	fmt.Printf("Snapshot hash: %x\n", snap.Hash)
+}
+
+func (cli *CommandLine) loadUTXO(file string) {
+	snap, err := cli.BlockChain.LoadSnapshot(file)
+	if err != nil {
+		fmt.Printf("Could not load snapshot: %s\n", err)
+		return
+	}
+	fmt.Printf("Loaded %d UTXO entries at height %d\n", len(snap.Entries), snap.Height)
+	fmt.Println("History will be back-filled from peers")
+}
+
+func (cli *CommandLine) exportBlocks(file string, args []string) {
+	from, to := int64(0), int64(-1)
+	if len(args) > 0 {
+		h, err := strconv.ParseInt(args[0], 10, 64)
+		HandleErr(err)
+		from = h
+	}
+	if len(args) > 1 {
+		h, err := strconv.ParseInt(args[1], 10, 64)
+		HandleErr(err)
+		to = h
+	}
+
+	count, err := cli.BlockChain.ExportBlocks(file, from, to)
+	if err != nil {
+		fmt.Printf("Export stopped after %d blocks: %s\n", count, err)
+		return
+	}
+	fmt.Printf("Exported %d blocks to %s\n", count, file)
+}
+
+func (cli *CommandLine) importBlocks(file string) {
+	imported, skipped, err := cli.BlockChain.ImportBlocks(file)
+	if err != nil {
+		fmt.Printf("Import stopped: %s\n", err)
+	}
+	fmt.Printf("Imported %d blocks, %d already known, tip at height %d\n",
+		imported, skipped, cli.BlockChain.GetBestHeight())
+}
+
+func (cli *CommandLine) utxoSetInfo() {
+	UTXOst := blockchain.UTXOSet{
+		BlockChain: cli.BlockChain,
+	}
+	stats := UTXOst.Stats()
+
+	fmt.Printf("Height          : %d\n", stats.Height)
+	fmt.Printf("Best block      : %x\n", stats.BestBlock)
+	fmt.Printf("Transactions    : %d\n", stats.Transactions)
+	fmt.Printf("Outputs         : %d\n", stats.Outputs)
+	fmt.Printf("Total value     : %d\n", stats.TotalValue)
+	fmt.Printf("Serialized size : %d bytes\n", stats.SerializedSize)
+	fmt.Printf("Set hash        : %x\n", stats.Hash)
+}
+
+func (cli *CommandLine) verifyChain(args []string) {
+	level := blockchain.VerifyUTXO
+	if len(args) > 0 {
+		l, err := strconv.Atoi(args[0])
+		HandleErr(err)
+		level = l
+	}
+
+	checked, err := cli.BlockChain.VerifyChain(level)
+	if err != nil {
+		fmt.Printf("Verification failed: %s\n", err)
+		return
+	}
+	fmt.Printf("Verified %d blocks at level %d\n", checked, level)
+}
+
 func (cli *CommandLine) printChain() {
 	cli.BlockChain.PrintBlockChain()
 }
@@ -135,16 +456,95 @@ func (cli *CommandLine) send(from, to, num string, mineNow bool) {
 		cbTx := blockchain.CoinbaseTx(from, "")
 		txs := []*blockchain.Tx{cbTx, tx}
 		block := cli.BlockChain.MineBlock(txs)
-		UTXOst.Update(block)
-	} else {
-		address, err := network.GetAvailablePeer()
+		_, err := cli.BlockChain.ProcessBlock(block)
 		HandleErr(err)
-		network.SendTx(address, tx)
-		fmt.Printf("Broadcasted transaction to %s\n", address)
+	} else {
+		cli.broadcast(tx)
 	}
 	fmt.Printf("Sent %d to %s\n", amount, to)
 }
 
+// hand tx to the first reachable peer
+func (cli *CommandLine) broadcast(tx *blockchain.Tx) {
+	address, err := network.GetAvailablePeer(append(cli.connect, cli.addNodes...)...)
+	HandleErr(err)
+
+	// a node of our own runs only until the peer took the transaction
+	listen := cli.listen
+	if listen == "" {
+		listen = "127.0.0.1:0"
+	}
+	HandleErr(network.Broadcast(tx, address, broadcastTimeout,
+		network.WithChain(cli.BlockChain), network.WithListenAddress(listen)))
+	fmt.Printf("Broadcasted transaction to %s\n", address)
+}
+
+func (cli *CommandLine) anchor(from, file string, mineNow bool) {
+	checkAddress(from)
+
+	// hash file contents
+	content, err := ioutil.ReadFile(file)
+	HandleErr(err)
+	hash := sha256.Sum256(content)
+
+	UTXOst := blockchain.UTXOSet{
+		BlockChain: cli.BlockChain,
+	}
+
+	wallets, err := wallet.CreateWallets(cli.nodeID)
+	HandleErr(err)
+
+	w := wallets.GetWallet(from)
+	tx := blockchain.NewDataTx(&w, hash[:], &UTXOst)
+
+	if mineNow {
+		cbTx := blockchain.CoinbaseTx(from, "")
+		txs := []*blockchain.Tx{cbTx, tx}
+		block := cli.BlockChain.MineBlock(txs)
+		_, err := cli.BlockChain.ProcessBlock(block)
+		HandleErr(err)
+	} else {
+		cli.broadcast(tx)
+	}
+	fmt.Printf("Anchored %x in transaction %x\n", hash, tx.ID)
+}
+
+func (cli *CommandLine) verifyAnchor(file string) {
+	content, err := ioutil.ReadFile(file)
+	HandleErr(err)
+	hash := sha256.Sum256(content)
+
+	block, txIdx, err := cli.BlockChain.FindData(hash[:])
+	if err != nil {
+		fmt.Printf("%x: %s\n", hash, err)
+		return
+	}
+
+	// without a root in the header nothing proves the anchor was mined
+	root := block.MerkleRoot
+	if root == nil {
+		fmt.Printf("%x: block %x has no merkle root\n", hash, block.Hash)
+		return
+	}
+	tx := block.Txs[txIdx]
+	proof := block.MerkleProof(txIdx)
+
+	fmt.Printf("Anchor         : %x\n", hash)
+	fmt.Printf("Block          : %x\n", block.Hash)
+	fmt.Printf("Height         : %d\n", block.Height)
+	fmt.Printf("Transaction    : %x\n", tx.ID)
+	fmt.Printf("Merkle root    : %x\n", root)
+	fmt.Println("Merkle proof   :")
+	for i, h := range proof.Hashes {
+		side := "right"
+		if proof.Left[i] {
+			side = "left"
+		}
+		fmt.Printf("\t%-5s %x\n", side, h)
+	}
+	fmt.Printf("Proof valid    : %s\n", strconv.FormatBool(proof.Verify(tx.ToBytes(), root)))
+}
+
 func (cli *CommandLine) Run() {
 
 	// get NODE_ID environment variable
@@ -154,13 +554,20 @@ func (cli *CommandLine) Run() {
 		runtime.Goexit()
 	}
 	cli.nodeID = nodeID
+	loadParams()
+	cli.loadPeerConfig()
+
+	// peer files can be read and changed beside a running node
+	if len(os.Args) > 1 && cli.runPeerCommand() {
+		return
+	}
 
 	// get blockchain
 	cli.BlockChain = blockchain.ContinueBlockChain(nodeID)
 
 	// close database safely
-	defer cli.BlockChain.Database.Close()
-	go CloseDB(cli.BlockChain)
+	defer cli.BlockChain.Close()
+	go cli.closeDB()
 
 	// default start node
 	if len(os.Args) == 1 {
@@ -171,6 +578,10 @@ func (cli *CommandLine) Run() {
 	switch os.Args[1] {
 	case "--reindexutxo":
 		cli.reindexUTXO()
+	case "--utxosetinfo":
+		cli.utxoSetInfo()
+	case "--verifychain":
+		cli.verifyChain(os.Args[2:])
 	case "--print":
 		cli.printChain()
 	case "--listaddresses":
@@ -196,6 +607,25 @@ func (cli *CommandLine) Run() {
 		} else {
 			cli.startNode(os.Args[2])
 		}
+	case "--connect", "--addnode":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		if os.Args[1] == "--connect" {
+			cli.connect = append(cli.connect, splitPeers(os.Args[2])...)
+		} else {
+			cli.addNodes = append(cli.addNodes, splitPeers(os.Args[2])...)
+		}
+		cli.startNode("")
+	case "--light":
+		cli.startLight()
+	case "--lightbalance":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.lightBalance(os.Args[2])
 	case "--send":
 		if len(os.Args) < 5 {
 			cli.printUsage()
@@ -205,12 +635,85 @@ func (cli *CommandLine) Run() {
 		} else {
 			cli.send(os.Args[2], os.Args[3], os.Args[4], os.Args[5] == "mine")
 		}
+	case "--anchor":
+		if len(os.Args) < 4 {
+			cli.printUsage()
+			runtime.Goexit()
+		} else if len(os.Args) < 5 {
+			cli.anchor(os.Args[2], os.Args[3], false)
+		} else {
+			cli.anchor(os.Args[2], os.Args[3], os.Args[4] == "mine")
+		}
+	case "--prune":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.prune(os.Args[2])
+	case "--dumputxo":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXO(os.Args[2], os.Args[3:])
+	case "--loadutxo":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.loadUTXO(os.Args[2])
+	case "--export":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.exportBlocks(os.Args[2], os.Args[3:])
+	case "--import":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.importBlocks(os.Args[2])
+	case "--verifyanchor":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.verifyAnchor(os.Args[2])
 	default:
 		cli.printUsage()
 		runtime.Goexit()
 	}
 }
 
+// commands that don't open the chain, false if os.Args isn't one
+func (cli *CommandLine) runPeerCommand() bool {
+	switch os.Args[1] {
+	case "--listpeers":
+		cli.listPeers()
+	case "--listbans":
+		cli.listBans()
+	case "--ban":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			runtime.Goexit()
+		} else if len(os.Args) < 4 {
+			cli.ban(os.Args[2], "")
+		} else {
+			cli.ban(os.Args[2], os.Args[3])
+		}
+	case "--clearbans":
+		if len(os.Args) < 3 {
+			cli.clearBans("")
+		} else {
+			cli.clearBans(os.Args[2])
+		}
+	default:
+		return false
+	}
+	return true
+}
+
 func HandleErr(err error) {
 	if err != nil {
 		log.Panic(err)
@@ -223,12 +726,30 @@ func checkAddress(address string) {
 	}
 }
 
-func CloseDB(chain *blockchain.BlockChain) {
+// stop the node and close the database on a signal
+func (cli *CommandLine) closeDB() {
 	die := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
 	die.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
-		chain.Database.Close()
+
+		cli.nodeMu.Lock()
+		if cli.node != nil {
+			cli.node.Stop()
+		}
+		cli.nodeMu.Unlock()
+
+		cli.BlockChain.Close()
 	})
 }
+
+// start node and keep it running until the process is stopped
+func (cli *CommandLine) runNode(node *network.Node) {
+	cli.nodeMu.Lock()
+	cli.node = node
+	cli.nodeMu.Unlock()
+
+	HandleErr(node.Start(context.Background()))
+	select {}
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"exx/gochain/blockchain"
+	"sync"
+	"sync/atomic"
+)
+
+type Kind int
+
+const (
+	BlockConnected Kind = iota
+	BlockDisconnected
+	TipChanged
+	TxAccepted
+	TxRemoved
+	PeerConnected
+	PeerDisconnected
+)
+
+var kindNames = []string{
+	"block connected",
+	"block disconnected",
+	"tip changed",
+	"tx accepted",
+	"tx removed",
+	"peer connected",
+	"peer disconnected",
+}
+
+func (kind Kind) String() string {
+	if kind < 0 || int(kind) >= len(kindNames) {
+		return "unknown"
+	}
+	return kindNames[kind]
+}
+
+// only the fields relevant to Kind are set
+type Event struct {
+	Kind  Kind
+	Block *blockchain.Block // block events and the new tip
+	Tx    *blockchain.Tx    // mempool events
+	Peer  string            // peer events
+}
+
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	kinds   map[Kind]bool // empty means every kind
+	bus     *Bus
+	dropped uint64
+}
+
+// events that didn't fit in the buffer
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// stop delivery and close C
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+
+	if _, ok := sub.bus.subs[sub]; ok {
+		delete(sub.bus.subs, sub)
+		close(sub.ch)
+	}
+}
+
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// receive events of the given kinds, or all of them, on a buffered channel
+func (bus *Bus) Subscribe(buffer int, kinds ...Kind) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{
+		C:     ch,
+		ch:    ch,
+		kinds: make(map[Kind]bool),
+		bus:   bus,
+	}
+	for _, kind := range kinds {
+		sub.kinds[kind] = true
+	}
+
+	bus.mu.Lock()
+	bus.subs[sub] = true
+	bus.mu.Unlock()
+
+	return sub
+}
+
+// deliver without blocking, a slow subscriber misses events rather than
+// stalling the node
+func (bus *Bus) Publish(event Event) {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for sub := range bus.subs {
+		if len(sub.kinds) > 0 && !sub.kinds[event.Kind] {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// block events for a change of the main chain, then the new tip
+func (bus *Bus) PublishUpdate(update *blockchain.ChainUpdate) {
+	for _, block := range update.Disconnected {
+		bus.Publish(Event{Kind: BlockDisconnected, Block: block})
+	}
+	for _, block := range update.Connected {
+		bus.Publish(Event{Kind: BlockConnected, Block: block})
+	}
+	if n := len(update.Connected); n > 0 {
+		bus.Publish(Event{Kind: TipChanged, Block: update.Connected[n-1]})
+	}
+}
@@ -0,0 +1,29 @@
+package events
+
+import "testing"
+
+// a full buffer drops and counts events instead of blocking the publisher
+func TestDroppedEvents(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(2, PeerConnected)
+	all := bus.Subscribe(10)
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Kind: PeerConnected})
+	}
+	bus.Publish(Event{Kind: PeerDisconnected})
+
+	if len(sub.C) != 2 || sub.Dropped() != 3 {
+		t.Fatalf("%d events buffered and %d dropped, want 2 and 3", len(sub.C), sub.Dropped())
+	}
+	if len(all.C) != 6 || all.Dropped() != 0 {
+		t.Fatalf("%d events buffered and %d dropped, want 6 and 0", len(all.C), all.Dropped())
+	}
+
+	// nothing is delivered or counted after unsubscribing
+	sub.Unsubscribe()
+	bus.Publish(Event{Kind: PeerConnected})
+	if sub.Dropped() != 3 {
+		t.Fatalf("%d dropped after unsubscribing", sub.Dropped())
+	}
+}
@@ -0,0 +1,283 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PeersPath     = "./tmp/peers_%s.data"
+	maxAddrs      = 1000 // per addr message
+	maxBookAddrs  = 5000 // kept in the book and its file
+	maxOutbound   = 8
+	addrHorizon   = 30 * 24 * time.Hour // older addresses are not gossiped or dialled
+	retryInterval = 10 * time.Minute
+	maxFailures   = 10
+
+	// newly learned addresses seen this recently are passed on
+	addrRelayAge   = 10 * time.Minute
+	addrRelayPeers = 2
+)
+
+// what we know about a peer address
+type KnownAddr struct {
+	Addr      string
+	LastSeen  int64 // unix time we or a gossiping peer last saw it up
+	LastTried int64
+	Successes int
+	Failures  int
+	Services  ServiceFlag // as of the last handshake
+	UserAgent string
+	Latency   time.Duration // last ping round trip
+}
+
+// addresses worth connecting to, saved between runs
+type addrBook struct {
+	mu    sync.Mutex
+	path  string // empty keeps the book in memory
+	addrs map[string]*KnownAddr
+}
+
+func newAddrBook(path string) *addrBook {
+	return &addrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddr),
+	}
+}
+
+// a missing file is an empty book
+func (book *addrBook) Load() error {
+	if book.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(book.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var addrs map[string]*KnownAddr
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&addrs); err != nil {
+		return err
+	}
+
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	// a file from before the book was bounded keeps its best addresses
+	if len(addrs) > maxBookAddrs {
+		now := time.Now()
+		var all []*KnownAddr
+		for _, ka := range addrs {
+			all = append(all, ka)
+		}
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].isTerrible(now) != all[j].isTerrible(now) {
+				return !all[i].isTerrible(now)
+			}
+			return all[i].LastSeen > all[j].LastSeen
+		})
+		for _, ka := range all[maxBookAddrs:] {
+			delete(addrs, ka.Addr)
+		}
+	}
+
+	book.addrs = addrs
+	return nil
+}
+
+func (book *addrBook) Save() error {
+	if book.path == "" {
+		return nil
+	}
+
+	book.mu.Lock()
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(book.addrs)
+	book.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(book.path, content.Bytes(), 0644)
+}
+
+// record an address seen at unix time seen, true if it was new
+func (book *addrBook) Add(address string, seen int64) bool {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if ka, ok := book.addrs[address]; ok {
+		if seen > ka.LastSeen {
+			ka.LastSeen = seen
+		}
+		return false
+	}
+	book.addrs[address] = &KnownAddr{Addr: address, LastSeen: seen}
+	if len(book.addrs) > maxBookAddrs && book.evict("") == address {
+		return false
+	}
+	return true
+}
+
+func (book *addrBook) Attempt(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	book.get(address).LastTried = time.Now().Unix()
+}
+
+// a handshake completed, true if the address had never answered before
+func (book *addrBook) Good(address string, services ServiceFlag, userAgent string) bool {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	now := time.Now().Unix()
+	ka := book.get(address)
+	ka.LastSeen = now
+	ka.LastTried = now
+	ka.Successes++
+	ka.Services = services
+	ka.UserAgent = userAgent
+
+	return ka.Successes == 1
+}
+
+// the entry for address, added if it is missing, callers hold mu
+func (book *addrBook) get(address string) *KnownAddr {
+	ka, ok := book.addrs[address]
+	if !ok {
+		ka = &KnownAddr{Addr: address}
+		book.addrs[address] = ka
+		if len(book.addrs) > maxBookAddrs {
+			book.evict(address)
+		}
+	}
+	return ka
+}
+
+// drop the worst address other than keep: terrible ones first, then the one
+// seen longest ago, callers hold mu
+func (book *addrBook) evict(keep string) string {
+	now := time.Now()
+	var worst *KnownAddr
+
+	for address, ka := range book.addrs {
+		if address == keep {
+			continue
+		}
+		if worst == nil {
+			worst = ka
+			continue
+		}
+		terrible, worstTerrible := ka.isTerrible(now), worst.isTerrible(now)
+		if terrible && !worstTerrible || terrible == worstTerrible && ka.LastSeen < worst.LastSeen {
+			worst = ka
+		}
+	}
+	if worst == nil {
+		return ""
+	}
+	delete(book.addrs, worst.Addr)
+	return worst.Addr
+}
+
+func (book *addrBook) Remove(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	delete(book.addrs, address)
+}
+
+func (book *addrBook) SetLatency(address string, latency time.Duration) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if ka, ok := book.addrs[address]; ok {
+		ka.Latency = latency
+	}
+}
+
+// a dial failed
+func (book *addrBook) Failed(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if ka, ok := book.addrs[address]; ok {
+		ka.Failures++
+	}
+}
+
+// up to max usable addresses, most recently seen first
+func (book *addrBook) Fresh(max int) []KnownAddr {
+	now := time.Now()
+	var fresh []KnownAddr
+
+	for _, ka := range book.List() {
+		if !ka.isTerrible(now) {
+			fresh = append(fresh, ka)
+		}
+	}
+	if len(fresh) > max {
+		fresh = fresh[:max]
+	}
+	return fresh
+}
+
+// every address, most recently seen first
+func (book *addrBook) List() []KnownAddr {
+	book.mu.Lock()
+	var all []KnownAddr
+	for _, ka := range book.addrs {
+		all = append(all, *ka)
+	}
+	book.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].LastSeen != all[j].LastSeen {
+			return all[i].LastSeen > all[j].LastSeen
+		}
+		return all[i].Failures < all[j].Failures
+	})
+	return all
+}
+
+// whether an address is due for another dial
+func (book *addrBook) ShouldTry(address string) bool {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	ka, ok := book.addrs[address]
+	if !ok {
+		return true
+	}
+
+	// wait a while after an attempt that did not succeed
+	failed := ka.LastTried > ka.LastSeen
+	return !failed || time.Since(time.Unix(ka.LastTried, 0)) > retryInterval
+}
+
+// not worth keeping or passing on
+func (ka *KnownAddr) isTerrible(now time.Time) bool {
+	if now.Sub(time.Unix(ka.LastSeen, 0)) > addrHorizon {
+		return true
+	}
+	if ka.Successes == 0 && ka.Failures >= 3 {
+		return true
+	}
+	return ka.Failures >= maxFailures && ka.Failures > ka.Successes
+}
+
+// read a peers file without starting a node
+func LoadPeers(path string) ([]KnownAddr, error) {
+	book := newAddrBook(path)
+	err := book.Load()
+
+	return book.List(), err
+}
@@ -0,0 +1,265 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"exx/gochain/blockchain"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BansPath     = "./tmp/bans_%s.data"
+	BanDuration  = 24 * time.Hour
+	banThreshold = 100
+)
+
+// misbehavior scores, a peer is banned once its total reaches banThreshold
+const (
+	scoreUnknownCommand = 10
+	scoreOversized      = 20
+	scoreUnconnected    = 20 // headers that build on nothing we know
+	scoreMalformed      = 50
+	scoreInvalid        = 100 // breaks consensus rules or fails a proof
+)
+
+type BanEntry struct {
+	Addr   string // host:port, or a host to ban every port on it
+	Until  int64  // unix time the ban ends
+	Reason string
+}
+
+// banned addresses, shared through a file with the CLI
+type banList struct {
+	mu   sync.Mutex
+	path string // empty keeps the list in memory
+	bans map[string]*BanEntry
+}
+
+func newBanList(path string) *banList {
+	return &banList{
+		path: path,
+		bans: make(map[string]*BanEntry),
+	}
+}
+
+// replace the list with the file, a missing file is an empty list
+func (list *banList) Load() error {
+	if list.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(list.path)
+	if os.IsNotExist(err) {
+		content, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bans := make(map[string]*BanEntry)
+	if len(content) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&bans); err != nil {
+			return err
+		}
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.bans = bans
+	return nil
+}
+
+// callers hold mu
+func (list *banList) save() error {
+	if list.path == "" {
+		return nil
+	}
+
+	// expired bans are dropped on the way out
+	now := time.Now().Unix()
+	for addr, ban := range list.bans {
+		if ban.Until <= now {
+			delete(list.bans, addr)
+		}
+	}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(list.bans); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(list.path, content.Bytes(), 0644)
+}
+
+// ban address for duration, keeping bans added to the file meanwhile
+func (list *banList) Ban(address string, duration time.Duration, reason string) error {
+	if err := list.Load(); err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.bans[address] = &BanEntry{
+		Addr:   address,
+		Until:  time.Now().Add(duration).Unix(),
+		Reason: reason,
+	}
+	return list.save()
+}
+
+// lift the ban on address, or every ban if address is empty
+func (list *banList) Clear(address string) (int, error) {
+	if err := list.Load(); err != nil {
+		return 0, err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	cleared := 0
+	for addr := range list.bans {
+		if address == "" || addr == address {
+			delete(list.bans, addr)
+			cleared++
+		}
+	}
+	return cleared, list.save()
+}
+
+// whether address, or the host it is on, is banned
+func (list *banList) IsBanned(address string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now().Unix()
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	for _, key := range []string{address, host} {
+		if ban, ok := list.bans[key]; ok && ban.Until > now {
+			return true
+		}
+	}
+	return false
+}
+
+// bans still in force, by address
+func (list *banList) List() []BanEntry {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now().Unix()
+	var bans []BanEntry
+	for _, ban := range list.bans {
+		if ban.Until > now {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Addr < bans[j].Addr })
+
+	return bans
+}
+
+// count a violation against the connection address speaks on
+func (node *Node) misbehaving(address string, score int, reason string) {
+	if peer := node.peerAt(address); peer != nil {
+		peer.misbehaving(score, reason)
+	}
+}
+
+// count a violation against the connection, banning where it comes from at the threshold
+func (peer *Peer) misbehaving(score int, reason string) {
+	peer.scoreMu.Lock()
+	peer.score += score
+	total := peer.score
+	peer.scoreMu.Unlock()
+
+	address := peer.banAddr()
+	if address == "" {
+		address = peer.conn.RemoteAddr().String()
+	}
+	fmt.Printf("Peer %s misbehaving (%d/%d): %s\n", address, total, banThreshold, reason)
+
+	if total >= banThreshold {
+		peer.node.ban(address, reason)
+		peer.Close()
+	}
+}
+
+// score data that broke consensus rules or failed a proof, other failures are our own
+func (node *Node) scoreRuleError(address string, err error) {
+	if _, ok := err.(blockchain.RuleError); ok {
+		node.misbehaving(address, scoreInvalid, err.Error())
+	}
+}
+
+func (node *Node) ban(address, reason string) {
+	if err := node.bans.Ban(address, BanDuration, reason); err != nil {
+		fmt.Printf("Could not save bans: %s\n", err)
+	}
+	fmt.Printf("Banned %s for %s\n", address, BanDuration)
+
+	node.disconnectBanned()
+}
+
+// close the connection to address and forget the node
+func (node *Node) disconnect(address string) {
+	node.peersMu.Lock()
+	peer := node.peers[address]
+	node.peersMu.Unlock()
+
+	if peer != nil {
+		peer.Close()
+	}
+	node.dropNode(address)
+}
+
+// apply bans added from the command line to connected peers
+func (node *Node) reloadBans() {
+	if err := node.bans.Load(); err != nil {
+		fmt.Printf("Could not load bans: %s\n", err)
+		return
+	}
+	node.disconnectBanned()
+}
+
+// close every connection a ban covers
+func (node *Node) disconnectBanned() {
+	node.peersMu.Lock()
+	var all []*Peer
+	for peer := range node.conns {
+		all = append(all, peer)
+	}
+	node.peersMu.Unlock()
+
+	for _, peer := range all {
+		if peer.isBanned() {
+			fmt.Printf("Disconnecting banned peer %s\n", peer.conn.RemoteAddr())
+			peer.Close()
+		}
+	}
+}
+
+func LoadBans(path string) ([]BanEntry, error) {
+	list := newBanList(path)
+	err := list.Load()
+
+	return list.List(), err
+}
+
+func AddBan(path, address string, duration time.Duration, reason string) error {
+	return newBanList(path).Ban(address, duration, reason)
+}
+
+// lift the ban on address, or every ban if address is empty
+func ClearBans(path, address string) (int, error) {
+	return newBanList(path).Clear(address)
+}
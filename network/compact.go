@@ -0,0 +1,284 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"exx/gochain/blockchain"
+	"fmt"
+	"math/rand"
+)
+
+const shortIDLen = 6
+
+// transaction sent in full inside a compact block
+type PrefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+type CmpctBlock struct {
+	AddrFrom  string
+	Header    []byte
+	Nonce     uint64
+	ShortIDs  [][]byte // one per transaction not prefilled, in block order
+	Prefilled []PrefilledTx
+}
+
+type GetBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type BlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Txs       [][]byte // in the order they were asked for
+}
+
+// block waiting for transactions missing from our pool
+type partialBlock struct {
+	Block   *blockchain.Block
+	Missing []int
+}
+
+// take the partial block waiting on hash, if any
+func (node *Node) takePending(hash []byte) *partialBlock {
+	node.compactMu.Lock()
+	defer node.compactMu.Unlock()
+
+	key := hex.EncodeToString(hash)
+	partial := node.pendingCompact[key]
+	delete(node.pendingCompact, key)
+
+	return partial
+}
+
+// salted per block so collisions can't be precomputed
+func shortID(blockHash []byte, nonce uint64, txID []byte) []byte {
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, nonce)
+
+	hash := sha256.Sum256(bytes.Join([][]byte{blockHash, salt, txID}, nil))
+	return hash[:shortIDLen]
+}
+
+func (node *Node) SendCmpctBlock(address string, b *blockchain.Block) {
+	data := CmpctBlock{
+		AddrFrom: node.address,
+		Header:   b.Header().ToBytes(),
+		Nonce:    rand.Uint64(),
+	}
+
+	// the coinbase is never in a peer's pool
+	for i, tx := range b.Txs {
+		if tx.IsCoinbase() {
+			data.Prefilled = append(data.Prefilled, PrefilledTx{i, tx.ToBytes()})
+			continue
+		}
+		data.ShortIDs = append(data.ShortIDs, shortID(b.Hash, data.Nonce, tx.ID))
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("cmpctblock"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) SendGetBlockTxn(address string, blockHash []byte, indexes []int) {
+	data := GetBlockTxn{
+		AddrFrom:  node.address,
+		BlockHash: blockHash,
+		Indexes:   indexes,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("getblocktxn"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) SendBlockTxn(address string, blockHash []byte, txs [][]byte) {
+	data := BlockTxn{
+		AddrFrom:  node.address,
+		BlockHash: blockHash,
+		Txs:       txs,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("blocktxn"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) HandleCmpctBlock(request []byte) {
+	var buff bytes.Buffer
+	var payload CmpctBlock
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	block, err := blockchain.DecodeBlock(payload.Header)
+	if err != nil {
+		node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+		return
+	}
+	key := hex.EncodeToString(block.Hash)
+
+	node.compactMu.Lock()
+	_, pending := node.pendingCompact[key]
+	node.compactMu.Unlock()
+	if pending || node.chain.HasBlock(block.Hash) {
+		return
+	}
+
+	// cheap checks before matching against the pool
+	if parent, err := node.chain.GetBlockByHash(block.PrevHash); err == nil {
+		if err := blockchain.CheckDifficulty(&parent, block); err != nil {
+			fmt.Printf("Rejected compact block %x: %s\n", block.Hash, err)
+			node.misbehaving(payload.AddrFrom, scoreInvalid, err.Error())
+			return
+		}
+	}
+	if !blockchain.NewProof(block).Validate() {
+		fmt.Printf("Rejected compact block %x: invalid proof of work\n", block.Hash)
+		node.misbehaving(payload.AddrFrom, scoreInvalid, "compact block with invalid proof of work")
+		return
+	}
+
+	// short ids shared by several pool transactions are ambiguous
+	pool := make(map[string]*blockchain.Tx)
+	for _, tx := range node.memoryPool.All() {
+		tx := tx
+		sid := string(shortID(block.Hash, payload.Nonce, tx.ID))
+		if _, ok := pool[sid]; ok {
+			pool[sid] = nil
+			continue
+		}
+		pool[sid] = &tx
+	}
+
+	total := len(payload.ShortIDs) + len(payload.Prefilled)
+	block.Txs = make([]*blockchain.Tx, total)
+	for _, pre := range payload.Prefilled {
+		if pre.Index < 0 || pre.Index >= total {
+			fmt.Printf("Rejected compact block %x: bad prefilled index\n", block.Hash)
+			node.misbehaving(payload.AddrFrom, scoreMalformed, "bad prefilled index")
+			return
+		}
+		tx, err := blockchain.DecodeTx(pre.Tx)
+		if err != nil {
+			node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+			return
+		}
+		block.Txs[pre.Index] = &tx
+	}
+
+	var missing []int
+	next := 0
+	for i := range block.Txs {
+		if block.Txs[i] != nil {
+			continue
+		}
+		if next >= len(payload.ShortIDs) {
+			fmt.Printf("Rejected compact block %x: bad prefilled index\n", block.Hash)
+			node.misbehaving(payload.AddrFrom, scoreMalformed, "bad prefilled index")
+			return
+		}
+		if tx := pool[string(payload.ShortIDs[next])]; tx != nil {
+			block.Txs[i] = tx
+		} else {
+			missing = append(missing, i)
+		}
+		next++
+	}
+
+	if len(missing) > 0 {
+		fmt.Printf("Compact block %x is missing %d transactions\n", block.Hash, len(missing))
+		node.compactMu.Lock()
+		node.pendingCompact[key] = &partialBlock{block, missing}
+		node.compactMu.Unlock()
+		node.SendGetBlockTxn(payload.AddrFrom, block.Hash, missing)
+		return
+	}
+	node.acceptCompact(payload.AddrFrom, block)
+}
+
+func (node *Node) HandleGetBlockTxn(request []byte) {
+	var buff bytes.Buffer
+	var payload GetBlockTxn
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	block, err := node.chain.GetBlockByHash(payload.BlockHash)
+	if err != nil || !node.chain.HasBlockBody(&block) {
+		node.SendNotFound(payload.AddrFrom, "block", payload.BlockHash)
+		return
+	}
+
+	var txs [][]byte
+	for _, idx := range payload.Indexes {
+		if idx < 0 || idx >= len(block.Txs) {
+			return
+		}
+		txs = append(txs, block.Txs[idx].ToBytes())
+	}
+	node.SendBlockTxn(payload.AddrFrom, payload.BlockHash, txs)
+}
+
+func (node *Node) HandleBlockTxn(request []byte) {
+	var buff bytes.Buffer
+	var payload BlockTxn
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	partial := node.takePending(payload.BlockHash)
+	if partial == nil {
+		return
+	}
+
+	if len(payload.Txs) != len(partial.Missing) {
+		node.SendGetData(payload.AddrFrom, "block", payload.BlockHash)
+		return
+	}
+	for i, idx := range partial.Missing {
+		tx, err := blockchain.DecodeTx(payload.Txs[i])
+		if err != nil {
+			node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+			return
+		}
+		partial.Block.Txs[idx] = &tx
+	}
+	node.acceptCompact(payload.AddrFrom, partial.Block)
+}
+
+// connect a reconstructed block, falling back to the full block
+func (node *Node) acceptCompact(address string, block *blockchain.Block) {
+
+	// a short id collision picked the wrong transaction
+	if !bytes.Equal(block.MerkleRoot, block.HashTxs()) {
+		fmt.Printf("Compact block %x did not reconstruct, fetching it in full\n", block.Hash)
+		node.SendGetData(address, "block", block.Hash)
+		return
+	}
+
+	update, err := node.chain.ProcessBlock(block)
+	if err == blockchain.ErrOrphanBlock {
+		node.SendGetBlocks(address, node.chain.BlockLocator())
+		return
+	}
+	if err != nil && err != blockchain.ErrKnownBlock {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		node.scoreRuleError(address, err)
+		return
+	}
+	if err == nil {
+		fmt.Printf("Reconstructed block %d from compact relay\n", block.Height)
+		node.chainUpdated(update, address)
+	}
+}
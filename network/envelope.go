@@ -0,0 +1,109 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// network magics keep nodes of different networks, and other coins, from talking
+const (
+	MainNetMagic uint32 = 0x67634d4e // "gcMN"
+	TestNetMagic uint32 = 0x6763544e // "gcTN"
+)
+
+const maxPayloadSize = 32 << 20
+
+var Magic = MainNetMagic
+
+// magic | command | payload length | checksum | protocol version
+type envelope struct {
+	Magic    uint32
+	Command  [commandLen]byte
+	Length   uint32
+	Checksum [4]byte
+	Version  uint32
+}
+
+// first 4 bytes of the double sha256
+func checksum(payload []byte) [4]byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	var sum [4]byte
+	copy(sum[:], second[:4])
+	return sum
+}
+
+// wrap a command and payload, as built by Cmd2Bytes, in an envelope
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) < commandLen {
+		return errors.New("Message has no command")
+	}
+	payload := data[commandLen:]
+
+	header := envelope{
+		Magic:    Magic,
+		Length:   uint32(len(payload)),
+		Checksum: checksum(payload),
+		Version:  version,
+	}
+	copy(header.Command[:], data[:commandLen])
+
+	var buff bytes.Buffer
+	HandleErr(binary.Write(&buff, binary.BigEndian, &header))
+	buff.Write(payload)
+
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+// read one envelope, checking it before the payload is decoded
+func readFrame(r io.Reader) (string, []byte, error) {
+	var header envelope
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return "", nil, err
+	}
+
+	if header.Magic != Magic {
+		return "", nil, fmt.Errorf("Wrong network magic %08x", header.Magic)
+	}
+	if header.Version < minVersion {
+		return "", nil, fmt.Errorf("Envelope version %d is older than %d", header.Version, minVersion)
+	}
+	if err := checkCommand(header.Command[:]); err != nil {
+		return "", nil, err
+	}
+	if header.Length > maxPayloadSize {
+		return "", nil, fmt.Errorf("Payload of %d bytes is too large", header.Length)
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if checksum(payload) != header.Checksum {
+		return "", nil, errors.New("Payload checksum mismatch")
+	}
+	return Bytes2Cmd(header.Command[:]), payload, nil
+}
+
+// printable ascii followed only by zero padding
+func checkCommand(cmd []byte) error {
+	padding := false
+	for _, c := range cmd {
+		switch {
+		case c == 0:
+			padding = true
+		case padding || c < 0x20 || c > 0x7e:
+			return errors.New("Malformed command")
+		}
+	}
+	if cmd[0] == 0 {
+		return errors.New("Empty command")
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"exx/gochain/blockchain"
+	"fmt"
+)
+
+const (
+	maxCFilters  = 1000
+	maxCFHeaders = 2000
+)
+
+type GetCFilters struct {
+	AddrFrom    string
+	StartHeight int64
+	StopHash    []byte
+}
+
+type CFilter struct {
+	BlockHash []byte
+	Filter    []byte
+}
+
+type CFilters struct {
+	AddrFrom string
+	Filters  []CFilter
+}
+
+type GetCFHeaders struct {
+	AddrFrom    string
+	StartHeight int64
+	StopHash    []byte
+}
+
+type CFHeaders struct {
+	AddrFrom     string
+	StopHash     []byte
+	PrevHeader   []byte   // filter header before StartHeight, nil at genesis
+	FilterHashes [][]byte // chained onto PrevHeader to get each header
+}
+
+func (node *Node) SendGetCFilters(address string, startHeight int64, stopHash []byte) {
+	data := GetCFilters{
+		AddrFrom:    node.address,
+		StartHeight: startHeight,
+		StopHash:    stopHash,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("getcfilters"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) SendGetCFHeaders(address string, startHeight int64, stopHash []byte) {
+	data := GetCFHeaders{
+		AddrFrom:    node.address,
+		StartHeight: startHeight,
+		StopHash:    stopHash,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("getcfheaders"), payload...)
+
+	node.SendData(address, request)
+}
+
+// main chain hashes from start up to and including stop
+func filterRange(chain *blockchain.BlockChain, start int64, stopHash []byte, max int) [][]byte {
+	stop, err := chain.GetBlockByHash(stopHash)
+	if err != nil || !chain.IsMainChain(&stop) || start < 0 || start > stop.Height {
+		return nil
+	}
+	if stop.Height-start >= int64(max) {
+		return nil
+	}
+
+	var hashes [][]byte
+	for height := start; height <= stop.Height; height++ {
+		hash, err := chain.GetHashByHeight(height)
+		if err != nil {
+			return nil
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func (node *Node) HandleGetCFilters(request []byte) {
+	var buff bytes.Buffer
+	var payload GetCFilters
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	data := CFilters{AddrFrom: node.address}
+	for _, hash := range filterRange(node.chain, payload.StartHeight, payload.StopHash, maxCFilters) {
+		filter, err := node.chain.GetFilter(hash)
+		if err != nil {
+			break
+		}
+		data.Filters = append(data.Filters, CFilter{hash, filter})
+	}
+	request = append(Cmd2Bytes("cfilters"), GobEncode(data)...)
+
+	node.SendData(payload.AddrFrom, request)
+}
+
+func (node *Node) HandleGetCFHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload GetCFHeaders
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	data := CFHeaders{AddrFrom: node.address, StopHash: payload.StopHash}
+	hashes := filterRange(node.chain, payload.StartHeight, payload.StopHash, maxCFHeaders)
+
+	if len(hashes) > 0 && payload.StartHeight > 0 {
+		prev, err := node.chain.GetHashByHeight(payload.StartHeight - 1)
+		if err == nil {
+			data.PrevHeader, err = node.chain.GetFilterHeader(prev)
+		}
+		if err != nil {
+			hashes = nil
+		}
+	}
+	for _, hash := range hashes {
+		filter, err := node.chain.GetFilter(hash)
+		if err != nil {
+			break
+		}
+		filterHash := sha256.Sum256(filter)
+		data.FilterHashes = append(data.FilterHashes, filterHash[:])
+	}
+	request = append(Cmd2Bytes("cfheaders"), GobEncode(data)...)
+
+	node.SendData(payload.AddrFrom, request)
+}
+
+func HandleCFilters(request []byte) {
+	var buff bytes.Buffer
+	var payload CFilters
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	fmt.Printf("Received %d filters from %s\n", len(payload.Filters), payload.AddrFrom)
+}
+
+func HandleCFHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload CFHeaders
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	header := payload.PrevHeader
+	for _, filterHash := range payload.FilterHashes {
+		header = blockchain.NextFilterHeader(filterHash, header)
+	}
+	fmt.Printf("Received %d filter headers from %s ending in %x\n",
+		len(payload.FilterHashes), payload.AddrFrom, header)
+}
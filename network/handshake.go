@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minVersion = 2 // oldest peer version we talk to
+	UserAgent  = "/gochain:0.3.0/"
+
+	nonceExpiry    = time.Minute // a version not answered by then is forgotten
+	minTimeSamples = 5
+	maxTimeSamples = 200
+	maxTimeOffset  = 70 * 60 // seconds the network may move our clock
+)
+
+// what a node serves, advertised in its version
+type ServiceFlag uint64
+
+const (
+	ServiceFull    ServiceFlag = 1 << iota // every block body
+	ServicePruned                          // recent block bodies only
+	ServiceFilters                         // compact block filters
+	ServiceLight                           // follows headers, serves nothing
+)
+
+func (flags ServiceFlag) Has(service ServiceFlag) bool {
+	return flags&service != 0
+}
+
+// whether blocks can be downloaded from the peer
+func (flags ServiceFlag) ServesBlocks() bool {
+	return flags.Has(ServiceFull) || flags.Has(ServicePruned)
+}
+
+func (flags ServiceFlag) String() string {
+	var names []string
+	for _, service := range []struct {
+		flag ServiceFlag
+		name string
+	}{
+		{ServiceFull, "full"},
+		{ServicePruned, "pruned"},
+		{ServiceFilters, "filters"},
+		{ServiceLight, "light"},
+	} {
+		if flags.Has(service.flag) {
+			names = append(names, service.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// sent before dropping a peer whose message we refuse
+type Reject struct {
+	AddrFrom string
+	Command  string
+	Reason   string
+}
+
+// nonce we sent in a version, to recognise it coming back to us
+type sentNonce struct {
+	Addr string
+	Sent time.Time
+}
+
+// version exchange state shared by every connection
+type handshakeState struct {
+	mu      sync.Mutex
+	nonces  map[uint64]sentNonce
+	self    map[string]bool // dialled addresses that turned out to be us
+	offsets map[*Peer]int64 // outbound peer clock minus ours in seconds
+	warned  bool
+}
+
+func newHandshakeState() *handshakeState {
+	return &handshakeState{
+		nonces:  make(map[uint64]sentNonce),
+		self:    make(map[string]bool),
+		offsets: make(map[*Peer]int64),
+	}
+}
+
+func randomNonce() uint64 {
+	var buff [8]byte
+	_, err := rand.Read(buff[:])
+	HandleErr(err)
+
+	return binary.BigEndian.Uint64(buff[:])
+}
+
+// our version, with a fresh nonce
+func (node *Node) localVersion() Version {
+	data := Version{
+		Version:   version,
+		AddrFrom:  node.address,
+		Timestamp: time.Now().Unix(),
+		Nonce:     randomNonce(),
+		UserAgent: UserAgent,
+	}
+
+	// a light node has no bodies or filters to serve
+	if node.light != nil {
+		data.BestHeight = node.light.BestHeight()
+		data.Services = ServiceLight
+		return data
+	}
+
+	data.BestHeight = node.chain.GetBestHeight()
+	data.Services = ServiceFull | ServiceFilters
+	if node.chain.IsPruned() {
+		data.Services = ServicePruned | ServiceFilters
+	}
+	return data
+}
+
+// remember the nonce of a version sent to address
+func (node *Node) sentVersion(address string, nonce uint64) {
+	hs := node.handshake
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for n, sent := range hs.nonces {
+		if time.Since(sent.Sent) > nonceExpiry {
+			delete(hs.nonces, n)
+		}
+	}
+	hs.nonces[nonce] = sentNonce{address, time.Now()}
+}
+
+// whether address is this node, by configuration or a version that came back
+func (node *Node) isSelf(address string) bool {
+	if address == node.address {
+		return true
+	}
+
+	node.handshake.mu.Lock()
+	defer node.handshake.mu.Unlock()
+
+	return node.handshake.self[address]
+}
+
+// check a peer's version or verack, false if the connection should not go on
+func (node *Node) acceptVersion(cmd string, payload *Version) bool {
+	hs := node.handshake
+
+	// our own version reached us, through whichever address we dialled
+	hs.mu.Lock()
+	sent, self := hs.nonces[payload.Nonce]
+	if self && cmd == "version" {
+		delete(hs.nonces, payload.Nonce)
+		hs.self[sent.Addr] = true
+	}
+	hs.mu.Unlock()
+
+	if self && cmd == "version" {
+		fmt.Printf("Connected to self at %s, disconnecting\n", sent.Addr)
+		node.addrs.Remove(sent.Addr)
+		node.disconnect(sent.Addr)
+		if payload.AddrFrom != sent.Addr {
+			node.disconnect(payload.AddrFrom)
+		}
+		return false
+	}
+
+	if payload.Version < minVersion {
+		reason := fmt.Sprintf("Version %d is older than %d", payload.Version, minVersion)
+		fmt.Printf("Rejected %s from %s: %s\n", cmd, payload.AddrFrom, reason)
+		node.SendReject(payload.AddrFrom, cmd, reason)
+		node.disconnect(payload.AddrFrom)
+		return false
+	}
+
+	if peer := node.peerAt(payload.AddrFrom); peer != nil {
+		node.addTimeSample(peer, payload.Timestamp)
+	}
+	node.setPeerVersion(payload.AddrFrom, payload)
+	return true
+}
+
+func (node *Node) SendReject(address, cmd, reason string) {
+	data := Reject{
+		AddrFrom: node.address,
+		Command:  cmd,
+		Reason:   reason,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("reject"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) handleReject(payload *Reject) {
+	fmt.Printf("Peer %s rejected our %s: %s\n", payload.AddrFrom, payload.Command, payload.Reason)
+}
+
+func (node *Node) HandleReject(request []byte) {
+	var buff bytes.Buffer
+	var payload Reject
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	node.handleReject(&payload)
+}
+
+// record how far a peer's clock is from ours, only peers we chose to dial count
+func (node *Node) addTimeSample(peer *Peer, timestamp int64) {
+	if !peer.outbound {
+		return
+	}
+
+	hs := node.handshake
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if _, ok := hs.offsets[peer]; !ok && len(hs.offsets) >= maxTimeSamples {
+		return
+	}
+	hs.offsets[peer] = timestamp - time.Now().Unix()
+
+	offset, ok := hs.medianOffset()
+	if !ok && !hs.warned && len(hs.offsets) >= minTimeSamples {
+		hs.warned = true
+		fmt.Printf("Clock is %ds away from its peers, check the system time\n", offset)
+	}
+}
+
+// a closed connection's clock no longer counts
+func (node *Node) removeTimeSample(peer *Peer) {
+	node.handshake.mu.Lock()
+	defer node.handshake.mu.Unlock()
+
+	delete(node.handshake.offsets, peer)
+}
+
+// median peer offset, false when there are too few samples or it is too far to trust
+func (hs *handshakeState) medianOffset() (int64, bool) {
+	if len(hs.offsets) < minTimeSamples {
+		return 0, false
+	}
+
+	var offsets []int64
+	for _, offset := range hs.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+
+	if median < -maxTimeOffset || median > maxTimeOffset {
+		return median, false
+	}
+	return median, true
+}
+
+// our clock moved by the median offset of peer clocks
+func (node *Node) AdjustedTime() time.Time {
+	node.handshake.mu.Lock()
+	offset, ok := node.handshake.medianOffset()
+	node.handshake.mu.Unlock()
+
+	if !ok {
+		offset = 0
+	}
+	return time.Now().Add(time.Duration(offset) * time.Second)
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"exx/gochain/blockchain"
+	"fmt"
+)
+
+func (node *Node) HandleLightMessage(cmd string, req []byte) {
+	node.lightMu.Lock()
+	defer node.lightMu.Unlock()
+
+	var buff bytes.Buffer
+	buff.Write(req)
+	dec := gob.NewDecoder(&buff)
+
+	switch cmd {
+	case "addr":
+		var payload Addr
+		HandleErr(dec.Decode(&payload))
+		node.learnAddrs(&payload)
+	case "version", "verack":
+		var payload Version
+		HandleErr(dec.Decode(&payload))
+		node.handleLightVersion(cmd, &payload)
+	case "ping":
+		var payload Ping
+		HandleErr(dec.Decode(&payload))
+		node.SendPong(payload.AddrFrom, payload.Nonce)
+	case "pong":
+		var payload Pong
+		HandleErr(dec.Decode(&payload))
+		node.handlePong(&payload)
+	case "reject":
+		var payload Reject
+		HandleErr(dec.Decode(&payload))
+		node.handleReject(&payload)
+	case "inv", "cmpctblock":
+		// a new block, or something in one, fetch its header
+		var payload Inventory
+		HandleErr(dec.Decode(&payload))
+		if payload.Type != "tx" {
+			node.SendGetHeaders(payload.AddrFrom, node.light.BlockLocator())
+		}
+	case "getdata":
+		var payload GetData
+		HandleErr(dec.Decode(&payload))
+		node.SendNotFound(payload.AddrFrom, payload.Type, payload.ID)
+	case "headers":
+		var payload Headers
+		HandleErr(dec.Decode(&payload))
+		node.handleLightHeaders(&payload)
+	case "cfheaders":
+		var payload CFHeaders
+		HandleErr(dec.Decode(&payload))
+		node.handleLightCFHeaders(&payload)
+	case "cfilters":
+		var payload CFilters
+		HandleErr(dec.Decode(&payload))
+		node.handleLightCFilters(&payload)
+	case "block":
+		var payload Block
+		HandleErr(dec.Decode(&payload))
+		node.handleLightBlock(&payload)
+	default:
+		fmt.Println("Ignored in light mode")
+	}
+}
+
+func (node *Node) handleLightVersion(cmd string, payload *Version) {
+	if !node.acceptVersion(cmd, payload) {
+		return
+	}
+	if cmd == "version" {
+		node.SendVersionAck(payload.AddrFrom)
+	}
+
+	// headers and filters only come from peers that serve filters
+	if payload.Services.Has(ServiceFilters) {
+		if _, err := node.light.Tip(); err != nil || node.light.BestHeight() < payload.BestHeight {
+			node.SendGetHeaders(payload.AddrFrom, node.light.BlockLocator())
+		} else {
+			node.requestFilterHeaders(payload.AddrFrom)
+		}
+	}
+
+	if node.NodeIsKnown(payload.AddrFrom) == false {
+		node.addPeer(payload)
+	}
+}
+
+func (node *Node) handleLightHeaders(payload *Headers) {
+	var headers []*blockchain.Block
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeBlock(data)
+		if err != nil {
+			node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+			return
+		}
+		headers = append(headers, header)
+	}
+
+	if err := node.light.AddHeaders(headers); err != nil {
+		fmt.Printf("Rejected headers from %s: %s\n", payload.AddrFrom, err)
+		if _, ok := err.(blockchain.RuleError); ok {
+			node.misbehaving(payload.AddrFrom, scoreInvalid, err.Error())
+		} else {
+			node.misbehaving(payload.AddrFrom, scoreUnconnected, err.Error())
+		}
+		return
+	}
+	if len(headers) > 0 {
+		fmt.Printf("Headers synced to height %d\n", node.light.BestHeight())
+	}
+
+	if len(headers) == maxHeaders {
+		node.SendGetHeaders(payload.AddrFrom, node.light.BlockLocator())
+	} else {
+		node.requestFilterHeaders(payload.AddrFrom)
+	}
+}
+
+// ask for filter headers of the next unscanned blocks
+func (node *Node) requestFilterHeaders(address string) {
+	start := node.light.ScanHeight() + 1
+	tip, err := node.light.Tip()
+	if err != nil || start > tip.Height {
+		fmt.Println("\nSynced")
+		return
+	}
+
+	stop := tip.Height
+	if stop-start >= maxCFilters {
+		stop = start + maxCFilters - 1
+	}
+	stopHash, err := node.light.GetHashByHeight(stop)
+	HandleErr(err)
+
+	node.SendGetCFHeaders(address, start, stopHash)
+}
+
+func (node *Node) handleLightCFHeaders(payload *CFHeaders) {
+	stop, err := node.light.GetHeader(payload.StopHash)
+	if err != nil || !node.light.IsMainChain(stop) || len(payload.FilterHashes) == 0 {
+		return
+	}
+	start := stop.Height - int64(len(payload.FilterHashes)) + 1
+	if start != node.light.ScanHeight()+1 {
+		return
+	}
+
+	// the first header must continue the chain we already checked
+	if start > 0 {
+		prevHash, err := node.light.GetHashByHeight(start - 1)
+		HandleErr(err)
+		prevHeader, err := node.light.GetFilterHeader(prevHash)
+		if err != nil || !bytes.Equal(prevHeader, payload.PrevHeader) {
+			fmt.Printf("Rejected filter headers from %s: they do not connect\n", payload.AddrFrom)
+			node.misbehaving(payload.AddrFrom, scoreUnconnected, "filter headers do not connect")
+			return
+		}
+	} else if payload.PrevHeader != nil {
+		return
+	}
+
+	header := payload.PrevHeader
+	for i, filterHash := range payload.FilterHashes {
+		header = blockchain.NextFilterHeader(filterHash, header)
+
+		hash, err := node.light.GetHashByHeight(start + int64(i))
+		HandleErr(err)
+
+		// peers must agree on what a block's filter is
+		if known, err := node.light.GetFilterHeader(hash); err == nil && !bytes.Equal(known, header) {
+			fmt.Printf("Peer %s disagrees on the filter at height %d\n", payload.AddrFrom, start+int64(i))
+			return
+		}
+		node.light.PutFilterHeader(hash, header)
+	}
+	node.SendGetCFilters(payload.AddrFrom, start, payload.StopHash)
+}
+
+func (node *Node) handleLightCFilters(payload *CFilters) {
+	items := node.light.WatchItems(node.watched)
+
+	for _, cf := range payload.Filters {
+		header, err := node.light.GetHeader(cf.BlockHash)
+		if err != nil || !node.light.IsMainChain(header) || header.Height != node.light.ScanHeight()+1 {
+			break
+		}
+
+		// the filter must hash to the header we were given
+		var prevHeader []byte
+		if header.PrevHash != nil {
+			prevHeader, err = node.light.GetFilterHeader(header.PrevHash)
+			HandleErr(err)
+		}
+		want, err := node.light.GetFilterHeader(cf.BlockHash)
+		if err != nil || !bytes.Equal(want, blockchain.FilterHeader(cf.Filter, prevHeader)) {
+			fmt.Printf("Rejected filter for block %x from %s\n", cf.BlockHash, payload.AddrFrom)
+			node.misbehaving(payload.AddrFrom, scoreInvalid, "filter does not match its header")
+			return
+		}
+
+		match, err := blockchain.MatchFilter(cf.BlockHash, cf.Filter, items)
+		if err != nil {
+			fmt.Printf("Rejected filter for block %x: %s\n", cf.BlockHash, err)
+			node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+			return
+		}
+		// the whole block is fetched so peers don't learn what we watch
+		if match {
+			node.SendGetData(payload.AddrFrom, "block", cf.BlockHash)
+		}
+		node.light.SetScanHeight(header.Height)
+	}
+	node.requestFilterHeaders(payload.AddrFrom)
+}
+
+// keep the transactions of a matched block that pay or spend what we watch
+func (node *Node) handleLightBlock(payload *Block) {
+	block, err := blockchain.DecodeBlock(payload.Block)
+	if err != nil {
+		node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+		return
+	}
+	header, err := node.light.GetHeader(block.Hash)
+	if err != nil {
+		return
+	}
+
+	// the body must be the one our header commits to
+	if header.MerkleRoot == nil || len(block.Txs) == 0 || !bytes.Equal(header.MerkleRoot, block.HashTxs()) {
+		fmt.Printf("Rejected block %x from %s: transactions do not match its header\n", block.Hash, payload.AddrFrom)
+		node.misbehaving(payload.AddrFrom, scoreInvalid, "block does not match its header")
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, item := range node.light.WatchItems(node.watched) {
+		wanted[string(item)] = true
+	}
+
+	for i, tx := range block.Txs {
+		for _, item := range blockchain.TxFilterItems(tx) {
+			if !wanted[string(item)] {
+				continue
+			}
+			HandleErr(node.light.AddTransaction(tx, header.Hash, block.MerkleProof(i)))
+			fmt.Printf("Found wallet transaction %x\n", tx.ID)
+			break
+		}
+	}
+}
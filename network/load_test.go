@@ -0,0 +1,135 @@
+package network
+
+import (
+	"context"
+	"exx/gochain/blockchain"
+	"exx/gochain/wallet"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chains and peer files go under a scratch directory, as ./tmp would for the cli
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gochain")
+	HandleErr(err)
+	HandleErr(os.Chdir(dir))
+
+	blockchain.Params.CoinbaseMaturity = 0
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// a chain for nodeID with a genesis block paying address, or empty to sync
+func testChain(t *testing.T, nodeID, address string) *blockchain.BlockChain {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	if address != "" {
+		chain.CreateBlockChain(address, nodeID)
+		blockchain.UTXOSet{BlockChain: chain}.Reindex()
+	}
+	return chain
+}
+
+// a node on a free loopback port, stopped before its chain is closed
+func startNode(t *testing.T, chain *blockchain.BlockChain, opts ...Option) *Node {
+	opts = append([]Option{WithChain(chain), WithListenAddress("127.0.0.1:0")}, opts...)
+	node := NewNode(opts...)
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Stop()
+		chain.Close()
+	})
+	return node
+}
+
+// poll until cond holds, failing after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// a miner and two syncing peers relay transactions while their chains are read
+// from other goroutines, run with -race
+func TestConcurrentLoad(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.GetAddress())
+
+	minerChain := testChain(t, "load_m", address)
+	miner := startNode(t, minerChain, WithMinerAddress(address))
+
+	chains := []*blockchain.BlockChain{minerChain}
+	var peers []*Node
+	for _, id := range []string{"load_a", "load_b"} {
+		chain := testChain(t, id, "")
+		chains = append(chains, chain)
+		peers = append(peers, startNode(t, chain, WithConnect(miner.Address())))
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	// wallet and api style readers while blocks are connected
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	for _, chain := range chains {
+		readers.Add(1)
+		go func(chain *blockchain.BlockChain) {
+			defer readers.Done()
+
+			UTXOst := blockchain.UTXOSet{BlockChain: chain}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				chain.GetBestHeight()
+				UTXOst.FindBalance(pubKeyHash)
+				UTXOst.CountTransactions()
+				UTXOst.Stats()
+			}
+		}(chain)
+	}
+
+	for _, peer := range peers {
+		peer := peer
+		waitFor(t, 10*time.Second, peer.Address()+" to connect", func() bool {
+			return peer.NodeIsKnown(miner.Address())
+		})
+	}
+
+	// spend from the miner's wallet through a peer, one transaction at a time
+	// so none of them conflict
+	UTXOst := blockchain.UTXOSet{BlockChain: minerChain}
+	for _, peer := range peers {
+		tx := blockchain.NewTx(w, address, 1, &UTXOst)
+		peer.SendTx(miner.Address(), tx)
+
+		waitFor(t, 30*time.Second, "the transaction to be mined", func() bool {
+			_, err := minerChain.FindTx(tx.ID)
+			return err == nil
+		})
+	}
+
+	height := minerChain.GetBestHeight()
+	for i, peer := range peers {
+		chain := chains[i+1]
+		waitFor(t, 30*time.Second, peer.Address()+" to sync", func() bool {
+			return chain.GetBestHeight() >= height
+		})
+	}
+
+	close(done)
+	readers.Wait()
+}
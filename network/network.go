@@ -5,30 +5,30 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"exx/gochain/blockchain"
+	"exx/gochain/events"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
+	"time"
 )
 
 const (
 	protocol     = "tcp"
-	version      = 1
+	version      = 3
 	commandLen   = 12
 	maxTXPoolSiz = 2
-)
-
-var (
-	nodeAddress     string
-	mineAddress     string
-	KnownNodes      = []string{}
-	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Tx)
+	maxPoolTxs   = 5000 // transactions kept waiting to be mined
+	maxInvBlocks = 500
 )
 
 type Addr struct {
-	AddrList []string
+	AddrFrom string
+	AddrList []NetAddr
+}
+
+// gossiped address and when it was last seen up
+type NetAddr struct {
+	Addr      string
+	Timestamp int64
 }
 
 type Block struct {
@@ -43,6 +43,7 @@ type GetBlock struct {
 
 type GetBlocks struct {
 	AddrFrom string
+	Locator  [][]byte // hashes from our tip back to genesis
 }
 
 type GetData struct {
@@ -51,6 +52,12 @@ type GetData struct {
 	ID       []byte
 }
 
+type NotFound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
 type Inventory struct {
 	AddrFrom string
 	Type     string
@@ -66,6 +73,10 @@ type Version struct { // remote procedure call (RPC)
 	Version    int
 	BestHeight int64 // to compare blockchain lengths
 	AddrFrom   string
+	Services   ServiceFlag
+	Timestamp  int64  // sender's clock, for network-adjusted time
+	Nonce      uint64 // a version carrying one of ours was sent to ourselves
+	UserAgent  string
 }
 
 func Cmd2Bytes(cmd string) []byte {
@@ -97,118 +108,140 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func SendAddr(address string) {
+// pass on the freshest addresses we know, and our own if we serve blocks
+func (node *Node) SendAddr(address string) {
+	var addrs []NetAddr
+	if node.chain != nil {
+		addrs = append(addrs, NetAddr{node.address, node.AdjustedTime().Unix()})
+	}
+	for _, ka := range node.addrs.Fresh(maxAddrs - 1) {
+		if ka.Addr != address {
+			addrs = append(addrs, NetAddr{ka.Addr, ka.LastSeen})
+		}
+	}
+	node.sendAddrs(address, addrs)
+}
+
+func (node *Node) sendAddrs(address string, addrs []NetAddr) {
 	nodes := Addr{
-		AddrList: KnownNodes,
+		AddrFrom: node.address,
+		AddrList: addrs,
 	}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
 	payload := GobEncode(nodes)
 	request := append(Cmd2Bytes("addr"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendBlock(address string, b *blockchain.Block) {
+func (node *Node) SendBlock(address string, b *blockchain.Block) {
 	data := Block{
-		AddrFrom: nodeAddress,
+		AddrFrom: node.address,
 		Block:    b.ToBytes(),
 	}
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("block"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendInv(address, kind string, items [][]byte) {
+func (node *Node) SendInv(address, kind string, items [][]byte) {
 	data := Inventory{
-		AddrFrom: nodeAddress,
+		AddrFrom: node.address,
 		Type:     kind,
 		Items:    items,
 	}
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("inv"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendTx(address string, tx *blockchain.Tx) {
+func (node *Node) SendTx(address string, tx *blockchain.Tx) {
 	data := Tx{
-		AddrFrom:    nodeAddress,
+		AddrFrom:    node.address,
 		Transaction: tx.ToBytes(),
 	}
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("tx"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendVersionAck(address string, chain *blockchain.BlockChain) {
-	data := Version{
-		Version:    version,
-		BestHeight: chain.GetBestHeight(),
-		AddrFrom:   nodeAddress,
-	}
+func (node *Node) SendVersionAck(address string) {
+	data := node.localVersion()
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("verack"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendVersion(address string, chain *blockchain.BlockChain) {
-	data := Version{
-		Version:    version,
-		BestHeight: chain.GetBestHeight(),
-		AddrFrom:   nodeAddress,
-	}
+func (node *Node) SendVersion(address string) {
+	data := node.localVersion()
+	node.sentVersion(address, data.Nonce)
+
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("version"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendGetBlocks(address string) {
+func (node *Node) SendGetBlocks(address string, locator [][]byte) {
 	data := GetBlocks{
-		AddrFrom: nodeAddress,
+		AddrFrom: node.address,
+		Locator:  locator,
 	}
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("getblocks"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendGetData(address, kind string, id []byte) {
+func (node *Node) SendGetData(address, kind string, id []byte) {
 	data := GetData{
-		AddrFrom: nodeAddress,
+		AddrFrom: node.address,
 		Type:     kind,
 		ID:       id,
 	}
 	payload := GobEncode(data)
 	request := append(Cmd2Bytes("getdata"), payload...)
 
-	SendData(address, request)
+	node.SendData(address, request)
 }
 
-func SendData(address string, data []byte) {
-	conn, err := net.Dial(protocol, address)
+func (node *Node) SendNotFound(address, kind string, id []byte) {
+	data := NotFound{
+		AddrFrom: node.address,
+		Type:     kind,
+		ID:       id,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("notfound"), payload...)
 
-	if err != nil {
-		var updatedNodes []string
-		for _, node := range KnownNodes {
-			if node != address {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-		KnownNodes = updatedNodes
+	node.SendData(address, request)
+}
 
+// queue data on the connection to address, dialing it if needed
+func (node *Node) SendData(address string, data []byte) {
+	peer, err := node.getPeer(address)
+	if err != nil {
+		node.addrs.Failed(address)
+		node.dropNode(address)
 		return
 	}
-	defer conn.Close()
+	peer.Send(data)
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	HandleErr(err)
+// forget a node we can no longer reach
+func (node *Node) dropNode(address string) {
+	if node.knownNodes.Remove(address) {
+		node.Events.Publish(events.Event{Kind: events.PeerDisconnected, Peer: address})
+
+		// its downloads go to other peers, callers may hold sync.mu
+		go node.retryBodies()
+	}
 }
 
-func HandleAddr(request []byte) {
+func (node *Node) HandleAddr(request []byte) {
 	var buff bytes.Buffer
 	var payload Addr
 
@@ -216,12 +249,70 @@ func HandleAddr(request []byte) {
 	dec := gob.NewDecoder(&buff)
 	HandleErr(dec.Decode(&payload))
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("%2d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	node.learnAddrs(&payload)
 }
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+// remember gossiped addresses, discover dials them if we are short of peers
+func (node *Node) learnAddrs(payload *Addr) {
+	now := node.AdjustedTime().Unix()
+	var learned []NetAddr
+
+	if len(payload.AddrList) > maxAddrs {
+		node.misbehaving(payload.AddrFrom, scoreOversized, fmt.Sprintf("%d addresses", len(payload.AddrList)))
+		return
+	}
+
+	for _, addr := range payload.AddrList {
+		if node.bans.IsBanned(addr.Addr) {
+			continue
+		}
+
+		// a clock far ahead must not make an address look fresh
+		seen := addr.Timestamp
+		if seen > now+10*60 {
+			seen = now - 5*24*60*60
+		}
+		if !node.isSelf(addr.Addr) && node.addrs.Add(addr.Addr, seen) {
+			learned = append(learned, NetAddr{addr.Addr, seen})
+		}
+	}
+	fmt.Printf("Learned %d new addresses from %s\n", len(learned), payload.AddrFrom)
+
+	if len(learned) > 0 {
+		node.relayAddrs(payload.AddrFrom, learned)
+
+		select {
+		case node.scanNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pass recently seen addresses on to a few peers so they spread
+func (node *Node) relayAddrs(from string, addrs []NetAddr) {
+	var fresh []NetAddr
+	for _, addr := range addrs {
+		if time.Since(time.Unix(addr.Timestamp, 0)) < addrRelayAge {
+			fresh = append(fresh, addr)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	relayed := 0
+	for _, addr := range node.knownNodes.List() {
+		if relayed == addrRelayPeers {
+			break
+		}
+		if addr != from {
+			node.sendAddrs(addr, fresh)
+			relayed++
+		}
+	}
+}
+
+func (node *Node) HandleBlock(request []byte) {
 	var buff bytes.Buffer
 	var payload Block
 
@@ -229,27 +320,65 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	HandleErr(dec.Decode(&payload))
 
-	blockData := payload.Block
-	block := blockchain.Bytes2Block(blockData)
-	chain.AddBlock(block)
+	block, err := blockchain.DecodeBlock(payload.Block)
+	if err != nil {
+		node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+		return
+	}
+
+	// history below a loaded snapshot
+	if bytes.Equal(block.Hash, node.chain.BackfillHash()) {
+		node.backfill(payload.AddrFrom, block)
+		return
+	}
 
-	fmt.Printf("Syncing blocks, %d remaining\n", len(blocksInTransit))
+	// bodies for a validated header chain
+	if node.receiveBody(block) {
+		return
+	}
 
-	if len(blocksInTransit) > 0 {
+	// validate and connect, known blocks are skipped
+	update, err := node.chain.ProcessBlock(block)
+	if err == nil {
+		node.chainUpdated(update, payload.AddrFrom)
+	} else if err != blockchain.ErrKnownBlock {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		node.scoreRuleError(payload.AddrFrom, err)
+		node.blocksInTransit.Clear()
+
+		// announced on top of blocks we are missing
+		if err == blockchain.ErrOrphanBlock {
+			node.SendGetBlocks(payload.AddrFrom, node.chain.BlockLocator())
+		}
+		return
+	}
 
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	fmt.Printf("Syncing blocks, %d remaining\n", node.blocksInTransit.Len())
 
-		blocksInTransit = blocksInTransit[1:]
+	if blockHash, more := node.blocksInTransit.Next(); blockHash != nil {
+		node.SendGetData(payload.AddrFrom, "block", blockHash)
+	} else if more {
+		node.SendGetBlocks(payload.AddrFrom, node.chain.BlockLocator())
 	} else {
 		fmt.Println("\nSynced")
 	}
-	UTXOst := blockchain.UTXOSet{
-		BlockChain: chain,
+}
+
+// store a block below the snapshot and ask for its parent
+func (node *Node) backfill(address string, block *blockchain.Block) {
+	if err := node.chain.AddHistoricalBlock(block); err != nil {
+		fmt.Printf("Rejected historical block %x: %s\n", block.Hash, err)
+		return
+	}
+	fmt.Printf("Back-filled block %d\n", block.Height)
+
+	if hash := node.chain.BackfillHash(); hash != nil {
+		node.SendGetData(address, "block", hash)
+	} else {
+		fmt.Println("History back-filled")
 	}
-	UTXOst.Reindex()
 }
-func HandleGetBlock(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleGetBlock(request []byte) {
 	var buff bytes.Buffer
 	var payload GetBlock
 
@@ -259,7 +388,7 @@ func HandleGetBlock(request []byte, chain *blockchain.BlockChain) {
 
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleGetBlocks(request []byte) {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
@@ -267,11 +396,12 @@ func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	HandleErr(dec.Decode(&payload))
 
-	blocks := chain.GetHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	// only what follows the fork with the requester
+	blocks := node.chain.GetHashesAfter(payload.Locator, maxInvBlocks)
+	node.SendInv(payload.AddrFrom, "block", blocks)
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleGetData(request []byte) {
 	var buff bytes.Buffer
 	var payload GetData
 
@@ -281,44 +411,75 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 
 	switch payload.Type {
 	case "block":
-		block, err := chain.GetBlockByHash([]byte(payload.ID))
-		if err != nil {
+		block, err := node.chain.GetBlockByHash([]byte(payload.ID))
+		if err != nil || !node.chain.HasBlockBody(&block) {
+			node.SendNotFound(payload.AddrFrom, payload.Type, payload.ID)
 			return
 		}
-		SendBlock(payload.AddrFrom, &block)
+		node.SendBlock(payload.AddrFrom, &block)
 	case "tx":
 		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
-
-		SendTx(payload.AddrFrom, &tx)
+		tx, ok := node.memoryPool.Get(txID)
+		if !ok {
+			node.SendNotFound(payload.AddrFrom, payload.Type, payload.ID)
+			return
+		}
+		node.markKnown(payload.AddrFrom, payload.ID)
+		node.SendTx(payload.AddrFrom, &tx)
 	default:
 		fmt.Printf("Unrecognised data type: %s\n", payload.Type)
 	}
 }
 
-func HandleVersionAck(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleNotFound(request []byte) {
 	var buff bytes.Buffer
-	var payload Version
+	var payload NotFound
 
 	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	HandleErr(dec.Decode(&payload))
 
-	bestHeight := chain.GetBestHeight()
+	fmt.Printf("Peer %s does not have %s %x\n", payload.AddrFrom, payload.Type, payload.ID)
+
+	// another peer announcing it can be asked
+	if payload.Type == "tx" {
+		if peer := node.txRequests.Failed(payload.ID, payload.AddrFrom); peer != "" {
+			node.SendGetData(peer, "tx", payload.ID)
+		}
+	}
+
+	if payload.Type == "block" {
+		node.takePending(payload.ID)
+	}
+	if payload.Type == "block" && node.bodyNotFound(payload.AddrFrom, payload.ID) {
+		return
+	}
+
+	// later blocks can't connect without this one
+	if payload.Type == "block" {
+		node.blocksInTransit.Clear()
+	}
+}
 
-	otherHeight := payload.BestHeight
+func (node *Node) HandleVersionAck(request []byte) {
+	var buff bytes.Buffer
+	var payload Version
 
-	// check if peer has longer blockchain
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	if !node.acceptVersion("verack", &payload) {
+		return
 	}
-	if NodeIsKnown(payload.AddrFrom) == false {
-		fmt.Printf("New peer at: %s\n", payload.AddrFrom)
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	node.syncFrom(&payload)
+
+	if node.NodeIsKnown(payload.AddrFrom) == false {
+		node.addPeer(&payload)
 	}
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleVersion(request []byte) {
 	var buff bytes.Buffer
 	var payload Version
 
@@ -326,25 +487,39 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	HandleErr(dec.Decode(&payload))
 
-	bestHeight := chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+	if !node.acceptVersion("version", &payload) {
+		return
+	}
 
 	// acknowledge peer
-	SendVersionAck(payload.AddrFrom, chain)
+	node.SendVersionAck(payload.AddrFrom)
+	node.syncFrom(&payload)
 
-	// check if peer has longer blockchain
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+	// add node to known nodes
+	if node.NodeIsKnown(payload.AddrFrom) == false {
+		node.addPeer(&payload)
 	}
+}
 
-	// add node to known nodes
-	if NodeIsKnown(payload.AddrFrom) == false {
-		fmt.Printf("New peer at: %s\n", payload.AddrFrom)
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+// download from a peer that has blocks we are missing
+func (node *Node) syncFrom(payload *Version) {
+	if !payload.Services.ServesBlocks() {
+		return
+	}
+	node.setPeerHeight(payload.AddrFrom, payload.BestHeight)
+
+	// check if peer has longer blockchain, headers come first
+	if node.behind(payload.BestHeight) {
+		node.SendGetHeaders(payload.AddrFrom, node.chain.BlockLocator())
+	}
+
+	// fetch missing history in the background from full peers
+	if hash := node.chain.BackfillHash(); hash != nil && payload.Services.Has(ServiceFull) {
+		node.SendGetData(payload.AddrFrom, "block", hash)
 	}
 }
 
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleTx(request []byte) {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -354,39 +529,55 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	HandleErr(dec.Decode(&payload))
 
 	// get transaction from payload
-	txData := payload.Transaction
-	tx := blockchain.Bytes2Tx(txData)
+	tx, err := blockchain.DecodeTx(payload.Transaction)
+	if err != nil {
+		node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+		return
+	}
+
+	node.txRequests.Done(tx.ID)
+	node.markKnown(payload.AddrFrom, tx.ID)
 
 	// check not in chain yet
-	_, err := chain.FindTx(tx.ID)
-	if err == nil {
+	if _, err := node.chain.FindTx(tx.ID); err == nil {
+		return
+	}
+
+	// coinbases must be mature by the next block
+	UTXOst := blockchain.UTXOSet{
+		BlockChain: node.chain,
+	}
+	if err := UTXOst.CheckMaturity(&tx, node.chain.GetBestHeight()+1); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return
+	}
+
+	// only valid transactions spending unspent outputs are pooled and relayed
+	if err := node.checkPoolTx(&tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		node.scoreRuleError(payload.AddrFrom, err)
 		return
 	}
 
 	// add to pool
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	if !node.memoryPool.Add(hex.EncodeToString(tx.ID), tx) {
+		return
+	}
+	node.Events.Publish(events.Event{Kind: events.TxAccepted, Tx: &tx})
 
 	// mine block if transation pool full and mining on
 	/*
-		mine := len(mineAddress) > 0 && len(memoryPool) >= maxTXPoolSiz
+		mine := len(node.minerAddress) > 0 && node.memoryPool.Len() >= maxTXPoolSiz
 		if mine {
-			MineTx(chain)
+			node.MineTx()
 		}
 	*/
-	for _, node := range KnownNodes {
-		if node != nodeAddress && node != payload.AddrFrom {
-
-			/*
-				// broadcast transaction or new chain
-				if !mine {
-					SendInv(node, "tx", [][]byte{tx.ID})
-				} else { */
-			SendVersion(node, chain)
-		}
-	}
+
+	// announced with the next batch to peers that don't have it
+	node.announceTx(tx.ID)
 }
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
+func (node *Node) HandleInv(request []byte) {
 	var buff bytes.Buffer
 	var payload Inventory
 
@@ -395,149 +586,220 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	HandleErr(dec.Decode(&payload))
 
 	fmt.Printf("Recevied Inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) > maxInvBlocks {
+		node.misbehaving(payload.AddrFrom, scoreOversized, fmt.Sprintf("%d inventory items", len(payload.Items)))
+		return
+	}
 
 	switch payload.Type {
 	case "block":
 
-		// if no blockchain, get all
-		if _, err := chain.GetLastBlock(); err != nil {
-			blocksInTransit = payload.Items
-		} else {
-
-			// get only new blocks
-			for i, h := range payload.Items {
-				if chain.ContainsBlock(h) {
-					blocksInTransit = payload.Items[:i]
-					break
-				}
-				if i == len(payload.Items)-1 {
-					blocksInTransit = payload.Items
-				}
+		// items are oldest first, skip blocks we already have
+		var hashes [][]byte
+		for _, h := range payload.Items {
+			if !node.chain.HasBlock(h) {
+				hashes = append(hashes, h)
 			}
 		}
-		if len(blocksInTransit) > 0 {
-			numHash := len(blocksInTransit)
-			blockHash := blocksInTransit[numHash-1]
-			SendGetData(payload.AddrFrom, "block", blockHash)
-
-			newInTransit := [][]byte{}
-			for i := numHash - 1; i >= 0; i-- {
-				b := blocksInTransit[i]
-				if bytes.Compare(b, blockHash) != 0 {
-					newInTransit = append(newInTransit, b)
-				}
-			}
-			blocksInTransit = newInTransit
+		node.blocksInTransit.Set(hashes, len(payload.Items) == maxInvBlocks)
+
+		if blockHash, more := node.blocksInTransit.Next(); blockHash != nil {
+			node.SendGetData(payload.AddrFrom, "block", blockHash)
+		} else if more {
+			node.SendGetBlocks(payload.AddrFrom, node.chain.BlockLocator())
 		}
 
 	case "tx":
-		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		// each transaction is asked of one announcing peer at a time
+		for _, txID := range payload.Items {
+			node.markKnown(payload.AddrFrom, txID)
+
+			if _, ok := node.memoryPool.Get(hex.EncodeToString(txID)); ok {
+				continue
+			}
+			if node.txRequests.Start(txID, payload.AddrFrom) {
+				node.SendGetData(payload.AddrFrom, "tx", txID)
+			}
 		}
 	}
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	req, err := ioutil.ReadAll(conn)
-	defer conn.Close()
-	HandleErr(err)
-
-	// skip bad connections
-	if len(req) < commandLen {
-		return
-	}
-
-	cmd := Bytes2Cmd(req[:commandLen])
-	req = req[commandLen:]
-	fmt.Printf("Received %s command\n", cmd)
-
+func (node *Node) HandleMessage(cmd string, req []byte) {
 	switch cmd {
 	case "addr":
-		HandleAddr(req)
+		node.HandleAddr(req)
 	case "block":
-		HandleBlock(req, chain)
+		node.HandleBlock(req)
 	case "inv":
-		HandleInv(req, chain)
+		node.HandleInv(req)
+	case "cmpctblock":
+		node.HandleCmpctBlock(req)
+	case "getblocktxn":
+		node.HandleGetBlockTxn(req)
+	case "blocktxn":
+		node.HandleBlockTxn(req)
 	case "getblocks":
-		HandleGetBlocks(req, chain)
+		node.HandleGetBlocks(req)
+	case "getcfilters":
+		node.HandleGetCFilters(req)
+	case "cfilters":
+		HandleCFilters(req)
+	case "getcfheaders":
+		node.HandleGetCFHeaders(req)
+	case "cfheaders":
+		HandleCFHeaders(req)
+	case "getheaders":
+		node.HandleGetHeaders(req)
+	case "headers":
+		node.HandleHeaders(req)
 	case "getdata":
-		HandleGetData(req, chain)
+		node.HandleGetData(req)
+	case "notfound":
+		node.HandleNotFound(req)
 	case "tx":
-		HandleTx(req, chain)
+		node.HandleTx(req)
+	case "ping":
+		node.HandlePing(req)
+	case "pong":
+		node.HandlePong(req)
+	case "reject":
+		node.HandleReject(req)
 	case "version":
-		HandleVersion(req, chain)
+		node.HandleVersion(req)
 	case "verack":
-		HandleVersionAck(req, chain)
+		node.HandleVersionAck(req)
 	default:
 		fmt.Println("Unknown command")
 	}
 }
 
-func EmptyPool(chain *blockchain.BlockChain) (txs []*blockchain.Tx) {
-	for id := range memoryPool {
-		tx := memoryPool[id]
-		delete(memoryPool, id)
+func (node *Node) EmptyPool() (txs []*blockchain.Tx) {
+	UTXOst := blockchain.UTXOSet{
+		BlockChain: node.chain,
+	}
+	height := node.chain.GetBestHeight() + 1
+
+	var candidates []*blockchain.Tx
+	for id, tx := range node.memoryPool.All() {
+		tx := tx
 
-		if chain.VerifyTx(&tx) {
-			txs = append(txs, &tx)
+		// leave immature spends for a later block
+		if UTXOst.CheckMaturity(&tx, height) != nil {
+			continue
 		}
+		node.removeFromPool(id)
+		candidates = append(candidates, &tx)
+	}
+
+	// the block is checked a transaction at a time, what it can't hold is dropped
+	txs, rejected := node.chain.SelectTxs(candidates)
+	for _, tx := range rejected {
+		fmt.Printf("Dropped transaction %x\n", tx.ID)
 	}
 	return txs
 }
 
-func MineTx(chain *blockchain.BlockChain) {
+// whether a loose transaction can join the pool
+func (node *Node) checkPoolTx(tx *blockchain.Tx) error {
+	if err := node.chain.CheckTx(tx); err != nil {
+		return err
+	}
+	if node.memoryPool.Conflicts(tx) {
+		return fmt.Errorf("Transaction %x spends an output a pooled transaction spends", tx.ID)
+	}
+	return nil
+}
+
+func (node *Node) MineTx() {
+
+	// gather transactions, the header commits to them
+	txs := node.EmptyPool()
+	cbTx := blockchain.CoinbaseTx(node.minerAddress, "")
+	txs = append(txs, cbTx)
 
 	// mine new block
 	fmt.Println("Mining...")
-	newBlock := chain.MineBlock([]*blockchain.Tx{})
-
-	// add transactions
-	txs := EmptyPool(chain)
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
-	newBlock.Txs = txs
+	newBlock := node.chain.MineBlock(txs)
 
 	// add block to chain
-	chain.AddBlock(newBlock)
+	update, err := node.chain.ProcessBlock(newBlock)
+	if err != nil {
+		fmt.Printf("Mined block rejected: %s\n", err)
 
-	// refresh UTXOs
-	UTXOst := blockchain.UTXOSet{
-		BlockChain: chain,
+		// transactions still valid on their own wait for another block
+		for _, tx := range txs {
+			if tx.IsCoinbase() || node.checkPoolTx(tx) != nil {
+				continue
+			}
+			if node.memoryPool.Add(hex.EncodeToString(tx.ID), *tx) {
+				node.Events.Publish(events.Event{Kind: events.TxAccepted, Tx: tx})
+			}
+		}
+		return
 	}
-	UTXOst.Reindex()
 	fmt.Println("New block mined")
+	node.chainUpdated(update, "")
 
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+	if node.memoryPool.Len() > 0 {
+		node.MineTx()
 	}
+}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
-		}
+// a peer finished its handshake
+func (node *Node) addPeer(payload *Version) {
+	address := payload.AddrFrom
+	fmt.Printf("New peer at: %s %s (%s)\n", address, payload.UserAgent, payload.Services)
+
+	if node.addrs.Good(address, payload.Services, payload.UserAgent) {
+		node.relayAddrs(address, []NetAddr{{address, time.Now().Unix()}})
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	if node.knownNodes.Add(address) {
+		node.Events.Publish(events.Event{Kind: events.PeerConnected, Peer: address})
+		node.SendAddr(address)
 	}
 }
 
-func NodeIsKnown(address string) bool {
-	for _, node := range KnownNodes {
-		if node == address {
-			return true
+func (node *Node) removeFromPool(id string) {
+	if tx, ok := node.memoryPool.Remove(id); ok {
+		node.Events.Publish(events.Event{Kind: events.TxRemoved, Tx: &tx})
+	}
+}
+
+// announce a main chain change and drop the transactions it confirmed, from is
+// the peer the blocks came from or empty for our own
+func (node *Node) chainUpdated(update *blockchain.ChainUpdate, from string) {
+	for _, block := range update.Connected {
+		for _, tx := range block.Txs {
+			node.removeFromPool(hex.EncodeToString(tx.ID))
+		}
+	}
+	node.Events.PublishUpdate(update)
+
+	if len(update.Connected) == 0 {
+		return
+	}
+
+	// peers other than the one it came from rebuild the new tip from their own pools
+	tip := update.Connected[len(update.Connected)-1]
+	for _, addr := range node.knownNodes.List() {
+		if addr != node.address && addr != from {
+			node.SendCmpctBlock(addr, tip)
 		}
 	}
-	return false
+}
+
+func (node *Node) NodeIsKnown(address string) bool {
+	return node.knownNodes.Has(address)
 }
 
 // helps to sync blockchains
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
+func (node *Node) RequestBlocks() {
+	locator := node.chain.BlockLocator()
+
+	for _, addr := range node.knownNodes.List() {
+		node.SendGetBlocks(addr, locator)
 	}
 }
 
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"exx/gochain/blockchain"
+	"exx/gochain/events"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errNodeStopped = errors.New("Node is stopped")
+	errPeerBanned  = errors.New("Peer is banned")
+)
+
+// a full or light node, several can run in one process
+type Node struct {
+	// notifications for wallets, indexers, miners and APIs
+	Events *events.Bus
+
+	chain        *blockchain.BlockChain
+	light        *blockchain.LightChain
+	watched      [][]byte // wallet pubkey hashes followed by a light node
+	address      string   // listening address, set before any connection is served
+	minerAddress string
+	seeds        []string // peers dialled on start and every scan
+	connectOnly  bool     // dial seeds and nothing else
+	addrs        *addrBook
+	bans         *banList
+	scanNow      chan struct{} // wakes discover early when addresses are learned
+
+	knownNodes      *nodeList
+	blocksInTransit *blockQueue
+	memoryPool      *txPool
+	txRequests      *txRequests
+	sync            *headerSync
+	handshake       *handshakeState
+
+	pendingCompact map[string]*partialBlock
+	compactMu      sync.Mutex
+	lightMu        sync.Mutex // scan state moves one message at a time
+
+	handle  func(cmd string, payload []byte) // nil until started
+	peers   map[string]*Peer                 // by listening address
+	conns   map[*Peer]bool                   // every open connection
+	peersMu sync.Mutex
+	stopped bool // guarded by peersMu
+
+	ln     net.Listener
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+type Option func(*Node)
+
+// validate and relay blocks for chain
+func WithChain(chain *blockchain.BlockChain) Option {
+	return func(node *Node) {
+		node.chain = chain
+	}
+}
+
+// follow headers and filters only, watching pubKeyHashes
+func WithLight(light *blockchain.LightChain, pubKeyHashes [][]byte) Option {
+	return func(node *Node) {
+		node.light = light
+		node.watched = pubKeyHashes
+	}
+}
+
+// host:port to listen on, by default the first free port in the ports file
+func WithListenAddress(address string) Option {
+	return func(node *Node) {
+		node.address = address
+	}
+}
+
+// mine blocks paying address
+func WithMinerAddress(address string) Option {
+	return func(node *Node) {
+		node.minerAddress = address
+	}
+}
+
+// always connect to addresses, besides those learned from gossip
+func WithPeers(addresses ...string) Option {
+	return func(node *Node) {
+		node.seeds = append(node.seeds, addresses...)
+	}
+}
+
+// connect to addresses only, gossiped addresses are remembered but not dialled
+func WithConnect(addresses ...string) Option {
+	return func(node *Node) {
+		node.seeds = append(node.seeds, addresses...)
+		node.connectOnly = true
+	}
+}
+
+// keep known addresses in path between runs
+func WithPeerFile(path string) Option {
+	return func(node *Node) {
+		node.addrs.path = path
+	}
+}
+
+// keep bans in path, where the command line can change them
+func WithBanFile(path string) Option {
+	return func(node *Node) {
+		node.bans.path = path
+	}
+}
+
+func NewNode(opts ...Option) *Node {
+	node := &Node{
+		Events:          events.NewBus(),
+		knownNodes:      &nodeList{},
+		blocksInTransit: &blockQueue{},
+		memoryPool:      newTxPool(maxPoolTxs),
+		txRequests:      newTxRequests(),
+		sync:            newHeaderSync(),
+		handshake:       newHandshakeState(),
+		pendingCompact:  make(map[string]*partialBlock),
+		peers:           make(map[string]*Peer),
+		conns:           make(map[*Peer]bool),
+		addrs:           newAddrBook(""),
+		bans:            newBanList(""),
+		scanNow:         make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(node)
+	}
+	return node
+}
+
+// listening address, known once started
+func (node *Node) Address() string {
+	return node.address
+}
+
+// listen, then connect, sync and mine in the background until ctx ends or Stop
+func (node *Node) Start(ctx context.Context) error {
+	if node.chain == nil && node.light == nil {
+		return errors.New("Node needs a chain or a light chain")
+	}
+	if err := node.addrs.Load(); err != nil {
+		return err
+	}
+	if err := node.bans.Load(); err != nil {
+		return err
+	}
+
+	// bound before any goroutine needs our address
+	ln, err := node.listen()
+	if err != nil {
+		return err
+	}
+	node.ln = ln
+	fmt.Printf("Sever started on: %s\n", node.address)
+
+	if node.light != nil {
+		node.handle = node.HandleLightMessage
+	} else {
+		node.handle = node.HandleMessage
+	}
+
+	ctx, node.cancel = context.WithCancel(ctx)
+	node.wg.Add(3)
+	go node.serve(ln)
+	go node.discover(ctx)
+	go node.keepalive(ctx)
+
+	if node.chain != nil {
+		node.wg.Add(2)
+		go node.flushUTXO(ctx)
+		go node.relayInv(ctx)
+	}
+	if node.chain != nil && node.minerAddress != "" {
+		node.wg.Add(1)
+		go node.mine(ctx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		node.Stop()
+	}()
+	return nil
+}
+
+// disconnect peers and wait for the node's goroutines, the chain is left open
+func (node *Node) Stop() {
+	node.once.Do(func() {
+		node.peersMu.Lock()
+		node.stopped = true
+		node.peersMu.Unlock()
+
+		if node.cancel != nil {
+			node.cancel()
+		}
+		if node.ln != nil {
+			node.ln.Close()
+		}
+		node.closePeers()
+		node.wg.Wait()
+
+		if err := node.addrs.Save(); err != nil {
+			fmt.Printf("Could not save peers: %s\n", err)
+		}
+	})
+}
+
+// hand tx to the peer at address from a node that runs until the handshake is
+// done and the transaction written, peers drop messages sent before a handshake
+func Broadcast(tx *blockchain.Tx, address string, timeout time.Duration, opts ...Option) error {
+	node := NewNode(append(opts, WithConnect(address))...)
+	connected := node.Events.Subscribe(maxOutbound, events.PeerConnected)
+	defer connected.Unsubscribe()
+
+	if err := node.Start(context.Background()); err != nil {
+		return err
+	}
+	defer node.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-connected.C:
+			if event.Peer == address {
+				node.SendTx(address, tx)
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("No handshake with %s", address)
+		}
+	}
+}
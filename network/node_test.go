@@ -0,0 +1,137 @@
+package network
+
+import (
+	"encoding/hex"
+	"exx/gochain/blockchain"
+	"exx/gochain/wallet"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// three nodes in a line sync a new block, then stop without leaving goroutines
+func TestNodesSyncAndStop(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.GetAddress())
+
+	chainA := testChain(t, "node_a", address)
+	chainB := testChain(t, "node_b", "")
+	chainC := testChain(t, "node_c", "")
+
+	// the chains' own goroutines outlive the nodes
+	before := runtime.NumGoroutine()
+
+	a := startNode(t, chainA)
+	b := startNode(t, chainB, WithConnect(a.Address()))
+	c := startNode(t, chainC, WithConnect(b.Address()))
+
+	waitFor(t, 10*time.Second, "the genesis block to reach c", func() bool {
+		_, err := chainC.GetLastBlock()
+		return err == nil
+	})
+
+	// one block mined here rather than by a mining loop
+	a.minerAddress = address
+	a.MineTx()
+	tip, err := chainA.GetLastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the mined block to reach c", func() bool {
+		return chainB.ContainsBlock(tip.Hash) && chainC.ContainsBlock(tip.Hash)
+	})
+
+	for _, node := range []*Node{c, b, a} {
+		node.Stop()
+	}
+
+	// a peer dropped on the way out may still be handing its downloads on
+	waitFor(t, 5*time.Second, "the nodes' goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+// the command line hands transactions to a peer from a node of its own
+func TestBroadcast(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.GetAddress())
+
+	chain := testChain(t, "broadcast_r", address)
+	receiver := startNode(t, chain)
+
+	tx := blockchain.NewTx(w, address, 1, &blockchain.UTXOSet{BlockChain: chain})
+	sender := testChain(t, "broadcast_s", "")
+	defer sender.Close()
+
+	err := Broadcast(tx, receiver.Address(), 10*time.Second, WithChain(sender), WithListenAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the transaction to be pooled", func() bool {
+		_, ok := receiver.memoryPool.Get(hex.EncodeToString(tx.ID))
+		return ok
+	})
+}
+
+// a second connection naming a connected peer's address doesn't take its place
+func TestBindKeepsFirstConnection(t *testing.T) {
+	a := startNode(t, testChain(t, "bind_a", string(wallet.MakeWallet().GetAddress())))
+	b := startNode(t, testChain(t, "bind_b", ""), WithConnect(a.Address()))
+
+	waitFor(t, 10*time.Second, "b to connect", func() bool {
+		return a.peerAt(b.Address()) != nil
+	})
+	first := a.peerAt(b.Address())
+
+	conn, err := net.Dial(protocol, a.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	claim := Version{Version: version, AddrFrom: b.Address(), Services: ServiceFull}
+	if err := writeFrame(conn, append(Cmd2Bytes("version"), GobEncode(claim)...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the impostor is disconnected without an answer
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("impostor connection not closed: %v", err)
+	}
+	if a.peerAt(b.Address()) != first {
+		t.Fatal("impostor took the connection of b")
+	}
+}
+
+// a block reaches a node the miner has no connection to
+func TestBlockRelay(t *testing.T) {
+	address := string(wallet.MakeWallet().GetAddress())
+
+	// a dials nobody, so it never learns of c
+	a := startNode(t, testChain(t, "relay_a", address), WithConnect())
+	b := startNode(t, testChain(t, "relay_b", ""), WithConnect(a.Address()))
+	chainC := testChain(t, "relay_c", "")
+	c := startNode(t, chainC, WithConnect(b.Address()))
+
+	waitFor(t, 10*time.Second, "the genesis block to reach c", func() bool {
+		_, err := chainC.GetLastBlock()
+		return err == nil
+	})
+
+	a.minerAddress = address
+	a.MineTx()
+	tip, err := a.chain.GetLastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the mined block to reach c", func() bool {
+		return chainC.ContainsBlock(tip.Hash)
+	})
+
+	if a.NodeIsKnown(c.Address()) || c.NodeIsKnown(a.Address()) {
+		t.Fatal("a and c connected to each other")
+	}
+}
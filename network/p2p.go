@@ -2,10 +2,9 @@ package network
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"exx/gochain/blockchain"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"strings"
@@ -14,8 +13,10 @@ import (
 )
 
 const (
-	aSecond  = 1_000_000_000
-	portPath = "./ports"
+	aSecond       = 1_000_000_000
+	portPath      = "./ports"
+	flushInterval = 60 * aSecond
+	scanInterval  = 30 * aSecond
 )
 
 type FileIter struct {
@@ -50,69 +51,61 @@ func (it *FileIter) Next() bool {
 	return true
 }
 
-func startServer(chain *blockchain.BlockChain) {
-	var address string
-	var ln net.Listener
-	var err error
+// bind the configured address, or the first free port in the ports file
+func (node *Node) listen() (net.Listener, error) {
+	if node.address != "" {
+		ln, err := net.Listen(protocol, node.address)
+		if err != nil {
+			return nil, err
+		}
+		node.address = ln.Addr().String()
+		return ln, nil
+	}
 
 	// create port iterator
 	ports := NewFileIter(portPath)
+	defer ports.Fd.Close()
 
 	// find avalible port
 	for ports.Next() {
 
 		// concat port to host
-		address = fmt.Sprintf("localhost:%s", ports.Line)
+		address := fmt.Sprintf("localhost:%s", ports.Line)
 
 		// try bind to port
-		ln, err = net.Listen(protocol, address)
+		ln, err := net.Listen(protocol, address)
 		if err == nil {
-			break
-		} else {
-			if strings.Contains(err.Error(), "bind: address already in use") {
-				continue
-			} else {
-				log.Panic(err)
-			}
+			node.address = address
+			return ln, nil
+		}
+		if !strings.Contains(err.Error(), "bind: address already in use") {
+			return nil, err
 		}
 	}
-	if err != nil {
-		log.Fatal("No available ports")
-	}
-	nodeAddress = address // save our address globaly
-
-	// start server
-	fmt.Printf("Sever started on: %s\n", address)
-	for {
-		conn, err := ln.Accept()
-		HandleErr(err)
-
-		HandleConnection(conn, chain)
-	}
+	return nil, errors.New("No available ports")
 }
 
-func GetAvailablePeer() (address string, err error) {
-
-	// create port iterator
-	ports := NewFileIter(portPath)
-
-	// iterate ports
-	for ports.Next() {
-
-		// concat port to host
-		address = fmt.Sprintf("localhost:%s", ports.Line)
+// first reachable address, trying addresses before the ports file
+func GetAvailablePeer(addresses ...string) (address string, err error) {
+	for _, address := range append(addresses, portAddresses()...) {
 
 		// try connect
-		conn, err := net.Dial(protocol, address)
+		conn, err := net.DialTimeout(protocol, address, writeTimeout)
 		if err == nil {
 			conn.Close()
-			return address, err
+			return address, nil
 		}
 	}
 	return "", errors.New("No peers avalible")
 }
 
-func searchForPeers(chain *blockchain.BlockChain) {
+// local test network addresses, none without a ports file
+func portAddresses() []string {
+	var addresses []string
+
+	if _, err := os.Stat(portPath); os.IsNotExist(err) {
+		return nil
+	}
 
 	// create port iterator
 	ports := NewFileIter(portPath)
@@ -121,42 +114,102 @@ func searchForPeers(chain *blockchain.BlockChain) {
 	for ports.Next() {
 
 		// concat port to host
-		address := fmt.Sprintf("localhost:%s", ports.Line)
+		addresses = append(addresses, fmt.Sprintf("localhost:%s", ports.Line))
+	}
+	return addresses
+}
 
-		// don't send to self
-		if address != nodeAddress && NodeIsKnown(address) == false {
+// dial configured peers, then the freshest addresses we know of
+func (node *Node) connectPeers() {
+	for _, address := range node.seeds {
+		if !node.isSelf(address) && node.NodeIsKnown(address) == false {
+			node.addrs.Attempt(address)
+			node.SendVersion(address)
+		}
+	}
+	if node.connectOnly {
+		return
+	}
 
-			// try send version
-			SendVersion(address, chain)
+	for _, ka := range node.addrs.Fresh(maxAddrs) {
+		if node.outboundCount() >= maxOutbound {
+			return
+		}
+
+		// an address that answered with our own nonce is not dialled again
+		if node.isSelf(ka.Addr) || node.NodeIsKnown(ka.Addr) || !node.addrs.ShouldTry(ka.Addr) {
+			continue
+		}
+		node.addrs.Attempt(ka.Addr)
+		node.SendVersion(ka.Addr)
+	}
+
+	// the local test network is probed every scan, and only remembered once it answers
+	for _, address := range portAddresses() {
+		if node.outboundCount() >= maxOutbound {
+			return
+		}
+		if !node.isSelf(address) && node.NodeIsKnown(address) == false {
+			node.SendVersion(address)
 		}
 	}
 }
 
-func Mine(chain *blockchain.BlockChain) {
-	for {
-		MineTx(chain)
+// connections we dialled, counting those still in the handshake
+func (node *Node) outboundCount() int {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+
+	count := 0
+	for peer := range node.conns {
+		if peer.outbound {
+			count++
+		}
 	}
+	return count
 }
 
-func StartP2P(chain *blockchain.BlockChain, minerAddress string) {
+// write cached UTXO changes to disk periodically
+func (node *Node) flushUTXO(ctx context.Context) {
+	defer node.wg.Done()
 
-	// set miner address globaly
-	mineAddress = minerAddress
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(flushInterval):
+			node.chain.FlushUTXO()
+		}
+	}
+}
 
-	// start server in go routine
-	go startServer(chain)
-	time.Sleep(aSecond)
+// mine until stopped, a block in progress is finished first
+func (node *Node) mine(ctx context.Context) {
+	defer node.wg.Done()
 
-	// start miner
-	if mineAddress != "" {
-		go Mine(chain)
+	for ctx.Err() == nil {
+		node.MineTx()
 	}
+}
+
+// scan for peers intermittently, or as soon as new addresses are learned
+func (node *Node) discover(ctx context.Context) {
+	defer node.wg.Done()
 
-	// scan for peers intermittently
 	for {
 		fmt.Println("Scanning for peers")
-		searchForPeers(chain)
+		node.reloadBans()
+		node.connectPeers()
 
-		time.Sleep(30 * aSecond) // 30 seconds
+		if err := node.addrs.Save(); err != nil {
+			fmt.Printf("Could not save peers: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-node.scanNow:
+		case <-time.After(scanInterval):
+		}
 	}
 }
@@ -0,0 +1,387 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sendQueueLen = 256
+	writeTimeout = 10 * aSecond
+)
+
+// long lived connection to another node
+type Peer struct {
+	Addr     string // listening address, known once the peer sends one, guarded by peersMu
+	bound    bool   // Addr was named by the handshake and can't change, guarded by peersMu
+	outbound bool   // we dialled it
+	node     *Node
+	conn     net.Conn
+	send     chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	written  sync.WaitGroup
+
+	pingMu    sync.Mutex
+	connected time.Time
+	lastRecv  time.Time // when the last message arrived
+	version   int       // agreed in the handshake, zero before it
+	pingNonce uint64    // of the unanswered ping, zero if there is none
+	pingSent  time.Time
+	latency   time.Duration // last round trip
+
+	invMu    sync.Mutex
+	services ServiceFlag // from the handshake
+	knownInv *knownInventory
+	invQueue [][]byte // transactions to announce in the next batch
+
+	scoreMu sync.Mutex
+	score   int // misbehavior on this connection
+}
+
+// callers hold peersMu, address is empty for connections we accepted, nil once the node stopped
+func (node *Node) newPeer(conn net.Conn, address string) *Peer {
+	if node.stopped {
+		conn.Close()
+		return nil
+	}
+
+	peer := &Peer{
+		Addr:     address,
+		outbound: address != "",
+		node:     node,
+		conn:     conn,
+		send:     make(chan []byte, sendQueueLen),
+		closed:   make(chan struct{}),
+		knownInv: newKnownInventory(),
+	}
+	peer.connected = time.Now()
+	peer.lastRecv = peer.connected
+	peer.written.Add(1)
+	node.conns[peer] = true
+	node.wg.Add(1)
+
+	go peer.readLoop()
+	go peer.writeLoop()
+
+	return peer
+}
+
+func (peer *Peer) readLoop() {
+	defer peer.node.wg.Done()
+	defer peer.Close()
+
+	for {
+		cmd, payload, err := readFrame(peer.conn)
+		if err == io.EOF || peer.isClosed() {
+			return
+		}
+
+		// the stream can't be trusted after a bad envelope
+		if err != nil {
+			fmt.Printf("Disconnecting %s: %s\n", peer.conn.RemoteAddr(), err)
+			return
+		}
+		peer.pingMu.Lock()
+		peer.lastRecv = time.Now()
+		peer.pingMu.Unlock()
+
+		if peer.node.handle == nil {
+			continue
+		}
+		address := addrFrom(payload)
+		if err := peer.bind(cmd, address); err != nil {
+			fmt.Printf("Disconnecting %s: %s\n", peer.conn.RemoteAddr(), err)
+			return
+		}
+		if peer.isBanned() {
+			fmt.Printf("Disconnecting banned peer %s\n", address)
+			return
+		}
+
+		// handlers only see payloads of the shape their command expects
+		if score, err := checkPayload(cmd, payload); err != nil {
+			if address == "" {
+				fmt.Printf("Disconnecting %s: %s\n", peer.conn.RemoteAddr(), err)
+				return
+			}
+			peer.misbehaving(score, err.Error())
+			continue
+		}
+
+		// each peer is served on its own goroutine
+		fmt.Printf("Received %s command\n", cmd)
+		peer.node.handle(cmd, payload)
+	}
+}
+
+func (peer *Peer) writeLoop() {
+	defer peer.written.Done()
+	defer peer.conn.Close()
+
+	write := func(data []byte) bool {
+		peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return writeFrame(peer.conn, data) == nil
+	}
+
+	for {
+		select {
+		case data := <-peer.send:
+			if !write(data) {
+				peer.Close()
+				return
+			}
+		case <-peer.closed:
+
+			// flush what was queued before the close
+			for {
+				select {
+				case data := <-peer.send:
+					if !write(data) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (peer *Peer) isClosed() bool {
+	select {
+	case <-peer.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// queue a message, false if the peer is gone or not keeping up
+func (peer *Peer) Send(data []byte) bool {
+	if peer.isClosed() {
+		return false
+	}
+
+	select {
+	case peer.send <- data:
+		return true
+	default:
+		peer.Close()
+		return false
+	}
+}
+
+// drop the connection, queued messages are still written
+func (peer *Peer) Close() {
+	peer.once.Do(func() {
+		close(peer.closed)
+
+		node := peer.node
+		node.peersMu.Lock()
+		address := peer.Addr
+		current := node.peers[address] == peer
+		for addr, p := range node.peers {
+			if p == peer {
+				delete(node.peers, addr) // also the address it was dialled at
+			}
+		}
+		delete(node.conns, peer)
+		node.peersMu.Unlock()
+
+		node.removeTimeSample(peer)
+
+		if current {
+			node.dropNode(address)
+		}
+	})
+}
+
+// the first version or verack names the address a connection speaks for, every
+// later message must come from it
+func (peer *Peer) bind(cmd, address string) error {
+	node := peer.node
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+
+	if peer.bound {
+		if address != peer.Addr {
+			return fmt.Errorf("%s from %s on the connection of %s", cmd, address, peer.Addr)
+		}
+		return nil
+	}
+
+	switch {
+	case cmd == "reject":
+		return nil // refuses the version we sent
+	case cmd != "version" && cmd != "verack":
+		return fmt.Errorf("%s before the handshake", cmd)
+	case address == "":
+		return fmt.Errorf("%s without an address", cmd)
+	}
+
+	// the first connection for an address keeps it
+	if current, ok := node.peers[address]; ok && current != peer {
+		return fmt.Errorf("%s for %s, which is already connected", cmd, address)
+	}
+	peer.bound = true
+	peer.Addr = address
+	node.peers[address] = peer
+
+	return nil
+}
+
+// what a ban on the peer covers: the host it connects from, or its listening
+// address on loopback, where every node shares the host
+func (peer *Peer) banAddr() string {
+	host, _, err := net.SplitHostPort(peer.conn.RemoteAddr().String())
+	if err == nil && !net.ParseIP(host).IsLoopback() {
+		return host
+	}
+
+	peer.node.peersMu.Lock()
+	defer peer.node.peersMu.Unlock()
+
+	return peer.Addr
+}
+
+// banned by the host it connects from or by its listening address
+func (peer *Peer) isBanned() bool {
+	bans := peer.node.bans
+	if bans.IsBanned(peer.conn.RemoteAddr().String()) {
+		return true
+	}
+
+	peer.node.peersMu.Lock()
+	address := peer.Addr
+	peer.node.peersMu.Unlock()
+
+	return address != "" && bans.IsBanned(address)
+}
+
+// connection to address, nil if there is none
+func (node *Node) peerAt(address string) *Peer {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+
+	return node.peers[address]
+}
+
+// existing connection to address, or a new one
+func (node *Node) getPeer(address string) (*Peer, error) {
+	node.peersMu.Lock()
+	peer, ok := node.peers[address]
+	node.peersMu.Unlock()
+	if ok {
+		return peer, nil
+	}
+
+	if node.bans.IsBanned(address) {
+		return nil, errPeerBanned
+	}
+	conn, err := net.DialTimeout(protocol, address, writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// another goroutine may have connected meanwhile, keep theirs
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+
+	if current, ok := node.peers[address]; ok {
+		conn.Close()
+		return current, nil
+	}
+	if peer = node.newPeer(conn, address); peer == nil {
+		return nil, errNodeStopped
+	}
+	node.peers[address] = peer
+
+	return peer, nil
+}
+
+// payload types by command, anything else is unknown
+var messageTypes = map[string]func() interface{}{
+	"addr":         func() interface{} { return &Addr{} },
+	"block":        func() interface{} { return &Block{} },
+	"blocktxn":     func() interface{} { return &BlockTxn{} },
+	"cfheaders":    func() interface{} { return &CFHeaders{} },
+	"cfilters":     func() interface{} { return &CFilters{} },
+	"cmpctblock":   func() interface{} { return &CmpctBlock{} },
+	"getblocks":    func() interface{} { return &GetBlocks{} },
+	"getblocktxn":  func() interface{} { return &GetBlockTxn{} },
+	"getcfheaders": func() interface{} { return &GetCFHeaders{} },
+	"getcfilters":  func() interface{} { return &GetCFilters{} },
+	"getdata":      func() interface{} { return &GetData{} },
+	"getheaders":   func() interface{} { return &GetHeaders{} },
+	"headers":      func() interface{} { return &Headers{} },
+	"inv":          func() interface{} { return &Inventory{} },
+	"notfound":     func() interface{} { return &NotFound{} },
+	"ping":         func() interface{} { return &Ping{} },
+	"pong":         func() interface{} { return &Pong{} },
+	"reject":       func() interface{} { return &Reject{} },
+	"tx":           func() interface{} { return &Tx{} },
+	"verack":       func() interface{} { return &Version{} },
+	"version":      func() interface{} { return &Version{} },
+}
+
+// the misbehavior score for a payload that doesn't decode as its command
+func checkPayload(cmd string, payload []byte) (int, error) {
+	newPayload, ok := messageTypes[cmd]
+	if !ok {
+		return scoreUnknownCommand, fmt.Errorf("Unknown command %q", cmd)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(newPayload()); err != nil {
+		return scoreMalformed, fmt.Errorf("Malformed %s: %s", cmd, err)
+	}
+	return 0, nil
+}
+
+// sender of a message, every payload starts with AddrFrom
+func addrFrom(payload []byte) string {
+	var from struct{ AddrFrom string }
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&from); err != nil {
+		return ""
+	}
+	return from.AddrFrom
+}
+
+// accept peers, each one handles its own messages
+func (node *Node) serve(ln net.Listener) {
+	defer node.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // listener closed by Stop
+		}
+		if node.bans.IsBanned(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+
+		node.peersMu.Lock()
+		node.newPeer(conn, "")
+		node.peersMu.Unlock()
+	}
+}
+
+// write out queued messages and disconnect
+func (node *Node) closePeers() {
+	node.peersMu.Lock()
+	var all []*Peer
+	for peer := range node.conns {
+		all = append(all, peer)
+	}
+	node.peersMu.Unlock()
+
+	for _, peer := range all {
+		peer.Close()
+		peer.written.Wait()
+	}
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+const (
+	pingVersion  = 3 // first version that answers pings
+	pingInterval = 30 * aSecond
+	pingTimeout  = 90 * aSecond // unanswered for this long and the peer is dropped
+
+	handshakeTimeout = 60 * aSecond      // to agree on versions after connecting
+	idleTimeout      = 20 * 60 * aSecond // without a message from a peer that can't be pinged
+)
+
+type Ping struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
+type Pong struct {
+	AddrFrom string
+	Nonce    uint64 // the ping's
+}
+
+func (node *Node) SendPing(peer *Peer) {
+	data := Ping{
+		AddrFrom: node.address,
+		Nonce:    randomNonce(),
+	}
+
+	peer.pingMu.Lock()
+	peer.pingNonce = data.Nonce
+	peer.pingSent = time.Now()
+	peer.pingMu.Unlock()
+
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("ping"), payload...)
+
+	peer.Send(request)
+}
+
+func (node *Node) SendPong(address string, nonce uint64) {
+	data := Pong{
+		AddrFrom: node.address,
+		Nonce:    nonce,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("pong"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) HandlePing(request []byte) {
+	var buff bytes.Buffer
+	var payload Ping
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	node.SendPong(payload.AddrFrom, payload.Nonce)
+}
+
+func (node *Node) HandlePong(request []byte) {
+	var buff bytes.Buffer
+	var payload Pong
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	node.handlePong(&payload)
+}
+
+// time the round trip of the ping being answered
+func (node *Node) handlePong(payload *Pong) {
+	peer := node.peerAt(payload.AddrFrom)
+	if peer == nil {
+		return
+	}
+
+	// a pong for an older ping, or one we never sent, says nothing
+	peer.pingMu.Lock()
+	if payload.Nonce == 0 || payload.Nonce != peer.pingNonce {
+		peer.pingMu.Unlock()
+		return
+	}
+	peer.pingNonce = 0
+	peer.latency = time.Since(peer.pingSent)
+	latency := peer.latency
+	peer.pingMu.Unlock()
+
+	node.addrs.SetLatency(payload.AddrFrom, latency)
+}
+
+// last round trip to address, zero if it was never measured
+func (node *Node) Latency(address string) time.Duration {
+	peer := node.peerAt(address)
+	if peer == nil {
+		return 0
+	}
+
+	peer.pingMu.Lock()
+	defer peer.pingMu.Unlock()
+
+	return peer.latency
+}
+
+// record what a peer's handshake settled on
+func (node *Node) setPeerVersion(address string, payload *Version) {
+	peer := node.peerAt(address)
+	if peer == nil {
+		return
+	}
+
+	peer.pingMu.Lock()
+	peer.version = payload.Version
+	peer.pingMu.Unlock()
+
+	peer.invMu.Lock()
+	peer.services = payload.Services
+	peer.invMu.Unlock()
+}
+
+// ping peers that can answer, dropping those that stopped answering, never
+// finished the handshake or went quiet, and move stalled downloads elsewhere
+func (node *Node) keepalive(ctx context.Context) {
+	defer node.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pingInterval):
+		}
+
+		node.retryBodies()
+
+		node.peersMu.Lock()
+		peers := make(map[*Peer]string)
+		for peer := range node.conns {
+			peers[peer] = peer.Addr
+		}
+		node.peersMu.Unlock()
+
+		for peer, address := range peers {
+			peer.pingMu.Lock()
+			pingable := peer.version >= pingVersion
+			waiting := peer.pingNonce != 0
+			overdue := waiting && time.Since(peer.pingSent) > pingTimeout
+			unversioned := peer.version == 0 && time.Since(peer.connected) > handshakeTimeout
+			idle := time.Since(peer.lastRecv) > idleTimeout
+			peer.pingMu.Unlock()
+
+			if address == "" {
+				address = peer.conn.RemoteAddr().String()
+			}
+			if unversioned {
+				fmt.Printf("Peer %s did not finish the handshake, disconnecting\n", address)
+				peer.Close()
+			} else if idle {
+				fmt.Printf("Peer %s has been idle too long, disconnecting\n", address)
+				peer.Close()
+			} else if overdue {
+				fmt.Printf("Peer %s stopped answering pings, disconnecting\n", address)
+				peer.Close()
+			} else if pingable && !waiting {
+				node.SendPing(peer)
+			}
+		}
+	}
+}
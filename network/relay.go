@@ -0,0 +1,219 @@
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	invInterval      = 2 * aSecond  // transaction announcements are batched this long
+	maxKnownInv      = 5000         // per peer, the oldest are forgotten first
+	txRequestTimeout = 30 * aSecond // before another peer is asked for a transaction
+	maxAnnouncers    = 8            // peers remembered per transaction to ask next
+)
+
+// inventory a peer has, or that we told it about
+type knownInventory struct {
+	items map[string]bool
+	order []string
+}
+
+func newKnownInventory() *knownInventory {
+	return &knownInventory{items: make(map[string]bool)}
+}
+
+func (known *knownInventory) Has(id []byte) bool {
+	return known.items[string(id)]
+}
+
+// false if id was already known
+func (known *knownInventory) Add(id []byte) bool {
+	key := string(id)
+	if known.items[key] {
+		return false
+	}
+	if len(known.order) >= maxKnownInv {
+		delete(known.items, known.order[0])
+		known.order = known.order[1:]
+	}
+	known.items[key] = true
+	known.order = append(known.order, key)
+
+	return true
+}
+
+// a transaction asked of one announcing peer, and the others to ask next
+type txRequest struct {
+	peer       string
+	since      time.Time
+	announcers []string
+}
+
+// transactions asked for and not yet received, by hex id
+type txRequests struct {
+	mu       sync.Mutex
+	requests map[string]*txRequest
+}
+
+func newTxRequests() *txRequests {
+	return &txRequests{requests: make(map[string]*txRequest)}
+}
+
+// peer announced id, true if it should be asked for it now
+func (requests *txRequests) Start(id []byte, peer string) bool {
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	req, ok := requests.requests[key]
+	if !ok {
+		requests.requests[key] = &txRequest{peer: peer, since: time.Now()}
+		return true
+	}
+
+	if req.peer == peer || len(req.announcers) >= maxAnnouncers {
+		return false
+	}
+	for _, announcer := range req.announcers {
+		if announcer == peer {
+			return false
+		}
+	}
+	req.announcers = append(req.announcers, peer)
+	return false
+}
+
+// the peer asked for id does not have it, the next announcer to ask or "" if none is left
+func (requests *txRequests) Failed(id []byte, peer string) string {
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	req, ok := requests.requests[key]
+	if !ok || req.peer != peer {
+		return ""
+	}
+	return requests.next(key, req)
+}
+
+// requests that timed out, moved on to their next announcer, by hex id
+func (requests *txRequests) Expired() map[string]string {
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	retry := make(map[string]string)
+	for key, req := range requests.requests {
+		if time.Since(req.since) < txRequestTimeout {
+			continue
+		}
+		if peer := requests.next(key, req); peer != "" {
+			retry[key] = peer
+		}
+	}
+	return retry
+}
+
+// hand a request to its next announcer, callers hold mu
+func (requests *txRequests) next(key string, req *txRequest) string {
+	if len(req.announcers) == 0 {
+		delete(requests.requests, key)
+		return ""
+	}
+	req.peer = req.announcers[0]
+	req.announcers = req.announcers[1:]
+	req.since = time.Now()
+
+	return req.peer
+}
+
+func (requests *txRequests) Done(id []byte) {
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	delete(requests.requests, hex.EncodeToString(id))
+}
+
+// the peer has, or was told about, id
+func (node *Node) markKnown(address string, id []byte) {
+	if peer := node.peerAt(address); peer != nil {
+		peer.invMu.Lock()
+		peer.knownInv.Add(id)
+		peer.invMu.Unlock()
+	}
+}
+
+// queue a transaction for every peer that hasn't seen it
+func (node *Node) announceTx(id []byte) {
+	node.peersMu.Lock()
+	var peers []*Peer
+	for _, peer := range node.peers {
+		peers = append(peers, peer)
+	}
+	node.peersMu.Unlock()
+
+	for _, peer := range peers {
+		peer.invMu.Lock()
+
+		// light peers have no use for unconfirmed transactions
+		if !peer.services.Has(ServiceLight) && peer.knownInv.Add(id) {
+			peer.invQueue = append(peer.invQueue, id)
+		}
+		peer.invMu.Unlock()
+	}
+}
+
+// send each peer its queued announcements in as few inv messages as possible,
+// and retry transaction requests that timed out
+func (node *Node) relayInv(ctx context.Context) {
+	defer node.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invInterval):
+		}
+
+		node.peersMu.Lock()
+		queues := make(map[string][][]byte)
+		for address, peer := range node.peers {
+			peer.invMu.Lock()
+			if len(peer.invQueue) > 0 {
+				queues[address] = peer.invQueue
+				peer.invQueue = nil
+			}
+			peer.invMu.Unlock()
+		}
+		node.peersMu.Unlock()
+
+		for address, queue := range queues {
+
+			// confirmed or evicted while queued
+			var items [][]byte
+			for _, id := range queue {
+				if _, ok := node.memoryPool.Get(hex.EncodeToString(id)); ok {
+					items = append(items, id)
+				}
+			}
+
+			// inv messages carry as many transactions as blocks
+			for len(items) > 0 {
+				n := len(items)
+				if n > maxInvBlocks {
+					n = maxInvBlocks
+				}
+				node.SendInv(address, "tx", items[:n])
+				items = items[n:]
+			}
+		}
+
+		// transactions a peer was too slow to send are asked of another
+		for key, peer := range node.txRequests.Expired() {
+			id, err := hex.DecodeString(key)
+			HandleErr(err)
+			node.SendGetData(peer, "tx", id)
+		}
+	}
+}
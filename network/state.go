@@ -0,0 +1,208 @@
+package network
+
+import (
+	"exx/gochain/blockchain"
+	"sync"
+)
+
+// addresses of nodes we know about
+type nodeList struct {
+	mu    sync.RWMutex
+	nodes []string
+}
+
+// false if address was already known
+func (list *nodeList) Add(address string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for _, node := range list.nodes {
+		if node == address {
+			return false
+		}
+	}
+	list.nodes = append(list.nodes, address)
+	return true
+}
+
+// false if address was not known
+func (list *nodeList) Remove(address string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for i, node := range list.nodes {
+		if node == address {
+			list.nodes = append(list.nodes[:i:i], list.nodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (list *nodeList) Has(address string) bool {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	for _, node := range list.nodes {
+		if node == address {
+			return true
+		}
+	}
+	return false
+}
+
+// copy safe to range over while the list changes
+func (list *nodeList) List() []string {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	return append([]string{}, list.nodes...)
+}
+
+func (list *nodeList) Len() int {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	return len(list.nodes)
+}
+
+// transactions waiting to be mined, by hex id
+type txPool struct {
+	mu     sync.RWMutex
+	max    int
+	txs    map[string]blockchain.Tx
+	spends map[string]string // pooled spender of each outpoint
+}
+
+func newTxPool(max int) *txPool {
+	return &txPool{
+		max:    max,
+		txs:    make(map[string]blockchain.Tx),
+		spends: make(map[string]string),
+	}
+}
+
+// false if the transaction was already pooled, spends an outpoint a pooled one
+// spends, or the pool is full
+func (pool *txPool) Add(id string, tx blockchain.Tx) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, ok := pool.txs[id]; ok || len(pool.txs) >= pool.max || pool.conflicts(&tx) {
+		return false
+	}
+	pool.txs[id] = tx
+	for _, in := range tx.Inputs {
+		pool.spends[outpoint(in)] = id
+	}
+	return true
+}
+
+// whether a pooled transaction spends an output tx spends
+func (pool *txPool) Conflicts(tx *blockchain.Tx) bool {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.conflicts(tx)
+}
+
+// callers hold mu
+func (pool *txPool) conflicts(tx *blockchain.Tx) bool {
+	if tx.IsCoinbase() {
+		return false
+	}
+	for _, in := range tx.Inputs {
+		if _, ok := pool.spends[outpoint(in)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func outpoint(in blockchain.TxIn) string {
+	return string(blockchain.OutpointItem(in.ID, in.Out))
+}
+
+func (pool *txPool) Get(id string) (blockchain.Tx, bool) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	tx, ok := pool.txs[id]
+	return tx, ok
+}
+
+func (pool *txPool) Remove(id string) (blockchain.Tx, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	tx, ok := pool.txs[id]
+	if ok {
+		for _, in := range tx.Inputs {
+			if pool.spends[outpoint(in)] == id {
+				delete(pool.spends, outpoint(in))
+			}
+		}
+	}
+	delete(pool.txs, id)
+	return tx, ok
+}
+
+// snapshot of the pool by hex id
+func (pool *txPool) All() map[string]blockchain.Tx {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	txs := make(map[string]blockchain.Tx, len(pool.txs))
+	for id, tx := range pool.txs {
+		txs[id] = tx
+	}
+	return txs
+}
+
+func (pool *txPool) Len() int {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return len(pool.txs)
+}
+
+// block hashes announced by inventory and still to be fetched, oldest first
+type blockQueue struct {
+	mu     sync.Mutex
+	hashes [][]byte
+	more   bool // the inventory was a full batch
+}
+
+func (queue *blockQueue) Set(hashes [][]byte, more bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.hashes = hashes
+	queue.more = more
+}
+
+// next hash to fetch, or whether to ask for another batch once empty
+func (queue *blockQueue) Next() (hash []byte, more bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(queue.hashes) > 0 {
+		hash = queue.hashes[0]
+		queue.hashes = queue.hashes[1:]
+		return hash, false
+	}
+	more = queue.more
+	queue.more = false
+	return nil, more
+}
+
+func (queue *blockQueue) Clear() {
+	queue.Set(nil, false)
+}
+
+func (queue *blockQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	return len(queue.hashes)
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"encoding/hex"
+	"exx/gochain/blockchain"
+	"testing"
+)
+
+func TestTxPoolRefusesConflicts(t *testing.T) {
+	pool := newTxPool(10)
+	in := blockchain.TxIn{ID: []byte{1}, Out: 0}
+
+	first := blockchain.Tx{ID: []byte{2}, Inputs: []blockchain.TxIn{in}}
+	second := blockchain.Tx{ID: []byte{3}, Inputs: []blockchain.TxIn{in}}
+
+	if !pool.Add(hex.EncodeToString(first.ID), first) {
+		t.Fatal("first spender refused")
+	}
+	if !pool.Conflicts(&second) || pool.Add(hex.EncodeToString(second.ID), second) {
+		t.Fatal("second spender of the same outpoint pooled")
+	}
+
+	// the outpoint is free again once its spender leaves
+	pool.Remove(hex.EncodeToString(first.ID))
+	if !pool.Add(hex.EncodeToString(second.ID), second) {
+		t.Fatal("spender refused after the conflict was removed")
+	}
+}
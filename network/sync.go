@@ -0,0 +1,360 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"exx/gochain/blockchain"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	maxHeaders        = 2000
+	maxBlocksInFlight = 16 // per peer
+	downloadWindow    = 1024
+	blockTimeout      = 30 * aSecond
+)
+
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+// body requested from a peer
+type download struct {
+	Peer  string
+	Since time.Time
+}
+
+// headers-first sync state
+type headerSync struct {
+	mu          sync.Mutex
+	queue       [][]byte                     // validated headers awaiting bodies, in chain order
+	headers     map[string]*blockchain.Block // pending header by hash
+	inFlight    map[string]download          // requested bodies by hash
+	received    map[string]*blockchain.Block // bodies waiting for their parent
+	senders     map[string]string            // peer each received body came from
+	peerHeights map[string]int64
+	peerMissing map[string]int64 // highest block a peer answered notfound for
+}
+
+func newHeaderSync() *headerSync {
+	return &headerSync{
+		headers:     make(map[string]*blockchain.Block),
+		inFlight:    make(map[string]download),
+		received:    make(map[string]*blockchain.Block),
+		senders:     make(map[string]string),
+		peerHeights: make(map[string]int64),
+		peerMissing: make(map[string]int64),
+	}
+}
+
+func (node *Node) SendGetHeaders(address string, locator [][]byte) {
+	data := GetHeaders{
+		AddrFrom: node.address,
+		Locator:  locator,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("getheaders"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) SendHeaders(address string, headers [][]byte) {
+	data := Headers{
+		AddrFrom: node.address,
+		Headers:  headers,
+	}
+	payload := GobEncode(data)
+	request := append(Cmd2Bytes("headers"), payload...)
+
+	node.SendData(address, request)
+}
+
+func (node *Node) HandleGetHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload GetHeaders
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	var headers [][]byte
+	for _, header := range node.chain.GetHeaders(payload.Locator, maxHeaders) {
+		headers = append(headers, header.ToBytes())
+	}
+	node.SendHeaders(payload.AddrFrom, headers)
+}
+
+func (node *Node) HandleHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload Headers
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	HandleErr(dec.Decode(&payload))
+
+	if len(payload.Headers) == 0 {
+		return
+	}
+	if len(payload.Headers) > maxHeaders {
+		node.misbehaving(payload.AddrFrom, scoreOversized, fmt.Sprintf("%d headers", len(payload.Headers)))
+		return
+	}
+
+	var headers []*blockchain.Block
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeBlock(data)
+		if err != nil {
+			node.misbehaving(payload.AddrFrom, scoreMalformed, err.Error())
+			return
+		}
+		headers = append(headers, header)
+	}
+	first, last := headers[0], headers[len(headers)-1]
+
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+
+	// the batch must build on a block or header we already have
+	var parent *blockchain.Block
+	if first.PrevHash != nil {
+		if block, err := node.chain.GetBlockByHash(first.PrevHash); err == nil {
+			parent = &block
+		} else if header, ok := node.sync.headers[hex.EncodeToString(first.PrevHash)]; ok {
+			parent = header
+		} else {
+			fmt.Printf("Rejected headers from %s: they do not connect\n", payload.AddrFrom)
+			node.misbehaving(payload.AddrFrom, scoreUnconnected, "headers do not connect")
+			return
+		}
+	}
+
+	// nothing is downloaded for a chain that fails its headers
+	if err := blockchain.CheckHeaders(parent, headers); err != nil {
+		fmt.Printf("Rejected headers from %s: %s\n", payload.AddrFrom, err)
+		node.misbehaving(payload.AddrFrom, scoreInvalid, err.Error())
+		return
+	}
+	fmt.Printf("Received %d valid headers up to height %d\n", len(headers), last.Height)
+	node.assumeCheckpointed(headers)
+
+	if last.Height > node.sync.peerHeights[payload.AddrFrom] {
+		node.sync.peerHeights[payload.AddrFrom] = last.Height
+	}
+
+	// only a longer chain is worth the bodies
+	if node.behind(last.Height) {
+		for _, header := range headers {
+			key := hex.EncodeToString(header.Hash)
+			if _, ok := node.sync.headers[key]; ok || node.chain.HasBlock(header.Hash) {
+				continue
+			}
+			node.sync.headers[key] = header
+			node.sync.queue = append(node.sync.queue, header.Hash)
+		}
+	}
+
+	// a full batch means the peer has more
+	if len(headers) == maxHeaders {
+		locator := append([][]byte{last.Hash}, node.chain.BlockLocator()...)
+		node.SendGetHeaders(payload.AddrFrom, locator)
+	}
+	node.requestBodies()
+}
+
+// whether a chain up to height is longer than ours, an empty chain has no
+// height and even a genesis block is worth fetching
+func (node *Node) behind(height int64) bool {
+	if _, err := node.chain.GetLastBlock(); err != nil {
+		return true
+	}
+	return node.chain.GetBestHeight() < height
+}
+
+// let the chain skip signatures on the way to the last checkpoint, callers hold sync.mu
+func (node *Node) assumeCheckpointed(headers []*blockchain.Block) {
+	last := blockchain.Params.LastCheckpoint()
+
+	batch := make(map[string]*blockchain.Block)
+	var checkpoint *blockchain.Block
+	for _, header := range headers {
+		batch[hex.EncodeToString(header.Hash)] = header
+		if header.Height == last {
+			checkpoint = header
+		}
+	}
+	if checkpoint == nil {
+		return
+	}
+
+	// back through this batch and the pending headers before it
+	path := []*blockchain.Block{checkpoint}
+	for curr := checkpoint; curr.PrevHash != nil; {
+		key := hex.EncodeToString(curr.PrevHash)
+		prev, ok := batch[key]
+		if !ok {
+			if prev, ok = node.sync.headers[key]; !ok {
+				break
+			}
+		}
+		path = append(path, prev)
+		curr = prev
+	}
+	node.chain.AssumeCheckpointed(path)
+}
+
+// spread body requests over peers that have them, callers hold sync.mu
+func (node *Node) requestBodies() {
+	counts := make(map[string]int)
+	for key, req := range node.sync.inFlight {
+		if !node.NodeIsKnown(req.Peer) || time.Since(req.Since) > blockTimeout {
+			delete(node.sync.inFlight, key)
+			continue
+		}
+		counts[req.Peer]++
+	}
+
+	for i, hash := range node.sync.queue {
+		if i >= downloadWindow {
+			break
+		}
+		key := hex.EncodeToString(hash)
+		if _, ok := node.sync.inFlight[key]; ok || node.sync.received[key] != nil {
+			continue
+		}
+
+		peer := node.pickPeer(node.sync.headers[key].Height, counts)
+		if peer == "" {
+			break
+		}
+		counts[peer]++
+		node.sync.inFlight[key] = download{peer, time.Now()}
+		node.SendGetData(peer, "block", hash)
+	}
+}
+
+// fastest peer with the block at height, the least busy of equally fast ones
+func (node *Node) pickPeer(height int64, counts map[string]int) string {
+	best := ""
+	var bestLatency time.Duration
+
+	for _, addr := range node.knownNodes.List() {
+		if addr == node.address || node.sync.peerHeights[addr] < height || counts[addr] >= maxBlocksInFlight {
+			continue
+		}
+		if missing, ok := node.sync.peerMissing[addr]; ok && height <= missing {
+			continue
+		}
+
+		// peers never pinged go after measured ones
+		latency := node.Latency(addr)
+		if latency == 0 {
+			latency = pingTimeout
+		}
+		if best == "" || latency < bestLatency || latency == bestLatency && counts[addr] < counts[best] {
+			best, bestLatency = addr, latency
+		}
+	}
+	return best
+}
+
+// claim a body we asked for, false if it was not part of the sync
+func (node *Node) receiveBody(block *blockchain.Block) bool {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+
+	key := hex.EncodeToString(block.Hash)
+	req, ok := node.sync.inFlight[key]
+	if !ok {
+		return false
+	}
+	delete(node.sync.inFlight, key)
+	node.sync.received[key] = block
+	node.sync.senders[key] = req.Peer
+
+	node.connectBodies()
+	node.requestBodies()
+
+	return true
+}
+
+// connect downloaded bodies in chain order
+func (node *Node) connectBodies() {
+	for len(node.sync.queue) > 0 {
+		key := hex.EncodeToString(node.sync.queue[0])
+		block := node.sync.received[key]
+		if block == nil {
+			return
+		}
+		sender := node.sync.senders[key]
+		delete(node.sync.received, key)
+		delete(node.sync.senders, key)
+		delete(node.sync.headers, key)
+		node.sync.queue = node.sync.queue[1:]
+
+		update, err := node.chain.ProcessBlock(block)
+		if err == nil {
+			node.chainUpdated(update, sender)
+		} else if err != blockchain.ErrKnownBlock {
+			fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+			node.scoreRuleError(sender, err)
+			node.resetSync()
+			return
+		}
+	}
+	fmt.Println("\nSynced")
+}
+
+// a body was unavailable, let another peer serve it
+func (node *Node) bodyNotFound(address string, hash []byte) bool {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+
+	key := hex.EncodeToString(hash)
+	req, ok := node.sync.inFlight[key]
+	if !ok || req.Peer != address {
+		return false
+	}
+	delete(node.sync.inFlight, key)
+
+	height := node.sync.headers[key].Height
+	if missing, ok := node.sync.peerMissing[address]; !ok || height > missing {
+		node.sync.peerMissing[address] = height
+	}
+	node.requestBodies()
+
+	return true
+}
+
+// hand bodies a gone or slow peer was asked for to another
+func (node *Node) retryBodies() {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+
+	if len(node.sync.inFlight) > 0 {
+		node.requestBodies()
+	}
+}
+
+func (node *Node) resetSync() {
+	node.sync.queue = [][]byte{}
+	node.sync.headers = make(map[string]*blockchain.Block)
+	node.sync.inFlight = make(map[string]download)
+	node.sync.received = make(map[string]*blockchain.Block)
+	node.sync.senders = make(map[string]string)
+}
+
+func (node *Node) setPeerHeight(address string, height int64) {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+
+	node.sync.peerHeights[address] = height
+}
@@ -27,7 +27,10 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	Handle(err)
 
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...) // ????
+	// x and y padded to 32 bytes each so the key splits evenly
+	public := make([]byte, 64)
+	private.PublicKey.X.FillBytes(public[:32])
+	private.PublicKey.Y.FillBytes(public[32:])
 	return *private, public
 }
 